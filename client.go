@@ -0,0 +1,241 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"code.google.com/p/go.net/websocket"
+)
+
+// ClientOptions are the parameters passed to Dial.
+type ClientOptions struct {
+	// Upgrade, if true, upgrades the connection to a WebSocket
+	// once the polling handshake has completed, provided the server
+	// offers the upgrade.
+	Upgrade bool
+	// HTTPClient is used to make polling requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// A client drives the client side of an FTC connection.
+type client struct {
+	url    *url.URL      // The server URL, including the session ID.
+	http   *http.Client  // Used to make polling requests.
+	c      *conn         // The connection handed to the caller.
+	paused int32         // Set atomically to stop polling before an upgrade.
+	polled chan struct{} // Closed once polling has stopped.
+}
+
+// Dial connects to the FTC server at rawurl, which should include
+// the server’s base path (e.g. http://localhost:5000/engine.io/).
+// The returned Conn reads and writes messages just as the Conn
+// passed to a server’s Handler does.
+func Dial(rawurl string, opts *ClientOptions) (*Conn, error) {
+	o := ClientOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.HTTPClient == nil {
+		o.HTTPClient = http.DefaultClient
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set(paramTransport, transportPolling)
+	u.RawQuery = q.Encode()
+	payload, err := getPayload(o.HTTPClient, u.String())
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) == 0 || payload[0].typ != packetTypeOpen {
+		return nil, errors.New("handshake did not begin with an open packet")
+	}
+	var hs struct {
+		SID      string   `json:"sid"`
+		Upgrades []string `json:"upgrades"`
+	}
+	if err := json.Unmarshal(payload[0].data, &hs); err != nil {
+		return nil, fmt.Errorf("could not decode handshake data: %v", err)
+	}
+	q.Set(paramSessionID, hs.SID)
+	u.RawQuery = q.Encode()
+	c := newConn()
+	c.id = hs.SID
+	cl := &client{url: u, http: o.HTTPClient, c: c, polled: make(chan struct{})}
+	for _, pkt := range payload[1:] {
+		cl.handlePacket(pkt)
+	}
+	go cl.send()
+	go cl.poll()
+	if o.Upgrade && offersUpgrade(hs.Upgrades, transportWebSocket) {
+		if err := cl.upgrade(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c.pubConn, nil
+}
+
+// offersUpgrade reports whether transport is among the upgrades
+// offered by the server in its handshake.
+func offersUpgrade(upgrades []string, transport string) bool {
+	for _, u := range upgrades {
+		if u == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// getPayload performs a polling GET and decodes the payload returned.
+func getPayload(client *http.Client, url string) ([]packet, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %q: %s", resp.Status, b)
+	}
+	var payload []packet
+	if err := newPayloadDecoder(resp.Body).decode(&payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// handlePacket responds to a packet received from the server.
+func (cl *client) handlePacket(pkt packet) {
+	switch pkt.typ {
+	case packetTypePing:
+		if err := cl.c.writePacket(packet{typ: packetTypePong, data: pkt.data}); err != nil {
+			cl.c.errorf("could not send pong: %v", err)
+		}
+	case packetTypeMessage:
+		cl.c.pubConn.onMessage(pkt.data, pkt.binary)
+	case packetTypeClose:
+		cl.c.close(DisconnectServer, nil)
+	}
+}
+
+// send posts the payloads written to the conn to the server until
+// the conn is closed.
+func (cl *client) send() {
+	for {
+		b, err := cl.c.next()
+		if err != nil {
+			return
+		}
+		resp, err := cl.http.Post(cl.url.String(), "text/plain;charset=UTF-8", bytes.NewReader(b))
+		if err != nil {
+			cl.c.close(DisconnectTransportError, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			cl.c.close(DisconnectTransportError, fmt.Errorf("unexpected status %q", resp.Status))
+			return
+		}
+	}
+}
+
+// poll receives payloads from the server until the conn is
+// closed or polling is paused for an upgrade.
+func (cl *client) poll() {
+	defer close(cl.polled)
+	for atomic.LoadInt32(&cl.paused) == 0 {
+		select {
+		case <-cl.c.done:
+			return
+		default:
+		}
+		payload, err := getPayload(cl.http, cl.url.String())
+		if err != nil {
+			cl.c.close(DisconnectTransportError, err)
+			return
+		}
+		for _, pkt := range payload {
+			cl.handlePacket(pkt)
+		}
+	}
+}
+
+// upgrade switches the conn to a WebSocket transport. Polling is
+// paused before the probe is sent. The server answers the probe by
+// releasing any in-flight poll with a noop, and that poll is allowed
+// to finish before the upgrade packet is sent, so no message is
+// received on both transports. If the upgrade fails, polling resumes.
+func (cl *client) upgrade() error {
+	u := *cl.url
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	q := u.Query()
+	q.Set(paramTransport, transportWebSocket)
+	u.RawQuery = q.Encode()
+	ws, err := websocket.Dial(u.String(), "", "http://"+u.Host)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&cl.paused, 1)
+	if err := cl.probe(ws); err != nil {
+		ws.Close()
+		<-cl.polled
+		atomic.StoreInt32(&cl.paused, 0)
+		cl.polled = make(chan struct{})
+		go cl.poll()
+		return err
+	}
+	cl.c.upgrade(ws)
+	go cl.read(ws)
+	return nil
+}
+
+// probe checks that the server answers a ping over ws, then waits
+// for polling to stop and sends the upgrade packet.
+func (cl *client) probe(ws *websocket.Conn) error {
+	enc, dec := newPacketEncoder(ws), newPacketDecoder(ws)
+	if err := enc.encode(packet{typ: packetTypePing, data: []byte("probe")}); err != nil {
+		return err
+	}
+	var pkt packet
+	if err := dec.decode(&pkt); err != nil {
+		return err
+	}
+	if pkt.typ != packetTypePong || string(pkt.data) != "probe" {
+		return errors.New("websocket probe failed")
+	}
+	<-cl.polled
+	return enc.encode(packet{typ: packetTypeUpgrade})
+}
+
+// read receives packets over the WebSocket until it is closed.
+func (cl *client) read(ws *websocket.Conn) {
+	dec := newPacketDecoder(ws)
+	for {
+		var pkt packet
+		if err := dec.decode(&pkt); err != nil {
+			cl.c.close(DisconnectTransportError, err)
+			return
+		}
+		cl.handlePacket(pkt)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDial(t *testing.T) {
+	ts := httptest.NewServer(NewServer(nil, echoHandler))
+	defer ts.Close()
+	for _, upgrade := range []bool{false, true} {
+		c, err := Dial(ts.URL+defaultBasePath, &ClientOptions{Upgrade: upgrade})
+		if err != nil {
+			t.Fatalf("upgrade %t: dial error: %v", upgrade, err)
+		}
+		if c.Upgraded() != upgrade {
+			t.Errorf("upgrade %t: expected upgraded to be %t", upgrade, upgrade)
+		}
+		if expected := map[bool]string{false: "polling", true: "websocket"}[upgrade]; c.Transport() != expected {
+			t.Errorf("upgrade %t: expected transport %q, got %q", upgrade, expected, c.Transport())
+		}
+		for _, msg := range [][]byte{[]byte("hello"), []byte("Foo 世 bar baz 界 qux")} {
+			if _, err := c.Write(msg); err != nil {
+				t.Fatalf("upgrade %t: write error: %v", upgrade, err)
+			}
+			b := make([]byte, 64)
+			n, err := c.Read(b)
+			if err != nil {
+				t.Fatalf("upgrade %t: read error: %v", upgrade, err)
+			}
+			if !bytes.Equal(b[:n], msg) {
+				t.Errorf("upgrade %t: expected echo of %q, got %q", upgrade, msg, b[:n])
+			}
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("upgrade %t: close error: %v", upgrade, err)
+		}
+	}
+}
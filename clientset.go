@@ -5,63 +5,156 @@
 
 package ftc
 
-import "sync"
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// numClientShards is the number of buckets a clientSet is split into.
+const numClientShards = 32
 
 // A clientSet represents a pool of connections keyed off
-// of their IDs.
+// of their IDs. The set is split into shards, each with its
+// own lock, so that handshakes and the reaper contend only
+// when they touch the same shard.
 type clientSet struct {
+	shards [numClientShards]clientShard
+}
+
+// A clientShard holds the connections whose IDs hash to it.
+type clientShard struct {
 	sync.RWMutex
 	clients map[string]*conn
 }
 
+// newClientSet returns an empty clientSet.
+func newClientSet() *clientSet {
+	c := &clientSet{}
+	for i := range c.shards {
+		c.shards[i].clients = map[string]*conn{}
+	}
+	return c
+}
+
+// shard returns the shard holding the connection with the given ID.
+func (c *clientSet) shard(id string) *clientShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &c.shards[h.Sum32()%numClientShards]
+}
+
 // get returns the connection with the given ID, nil otherwise.
 // empty ids are not supported and will always return nil.
 func (c *clientSet) get(id string) *conn {
-	c.RLock()
-	defer c.RUnlock()
-	return c.clients[id]
+	s := c.shard(id)
+	s.RLock()
+	defer s.RUnlock()
+	return s.clients[id]
 }
 
-// add adds a connection to the set keyed off its ID field.
-// If a conn has an empty ID, it is not added to the set.
-func (c *clientSet) add(con *conn) {
+// add adds a connection to the set keyed off its ID field and
+// returns true if it was added. A conn with an empty ID, or with
+// the same ID as another open conn in the set, is not added.
+func (c *clientSet) add(con *conn) bool {
 	if len(con.id) == 0 {
-		return
+		return false
+	}
+	s := c.shard(con.id)
+	s.Lock()
+	defer s.Unlock()
+	if existing := s.clients[con.id]; existing != nil && existing != con && !existing.isClosed() {
+		return false
 	}
-	c.Lock()
-	c.clients[con.id] = con
-	c.Unlock()
+	s.clients[con.id] = con
+	return true
 }
 
-// remove removes a connection from the set.
-func (c *clientSet) remove(con *conn) {
-	c.Lock()
-	delete(c.clients, con.id)
-	c.Unlock()
+// remove removes a connection from the set and returns true if it
+// was present. A newer connection that has reused its ID is left in
+// place.
+func (c *clientSet) remove(con *conn) bool {
+	s := c.shard(con.id)
+	s.Lock()
+	defer s.Unlock()
+	if s.clients[con.id] != con {
+		return false
+	}
+	delete(s.clients, con.id)
+	return true
 }
 
 // len returns the number of connections in the set.
 // The connections may be open or closed.
 func (c *clientSet) len() int {
-	c.RLock()
-	defer c.RUnlock()
-	return len(c.clients)
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		n += len(s.clients)
+		s.RUnlock()
+	}
+	return n
+}
+
+// forEach calls fn for each open connection in the set until fn
+// returns false. Each shard’s read lock is held while its
+// connections are visited.
+func (c *clientSet) forEach(fn func(*conn) bool) {
+	for i := range c.shards {
+		if !c.shards[i].forEach(fn) {
+			return
+		}
+	}
+}
+
+// forEach calls fn for each open connection in the shard, returning
+// false if fn did.
+func (s *clientShard) forEach(fn func(*conn) bool) bool {
+	s.RLock()
+	defer s.RUnlock()
+	for _, con := range s.clients {
+		if con.isClosed() {
+			continue
+		}
+		if !fn(con) {
+			return false
+		}
+	}
+	return true
 }
 
 // reap iterates through the set and removes any closed
-// connections.
-func (c *clientSet) reap() {
-	c.RLock()
-	toDelete := []string{}
-	for k, s := range c.clients {
-		if s.closed {
-			toDelete = append(toDelete, k)
+// connections, returning those it removed.
+func (c *clientSet) reap() []*conn {
+	var reaped []*conn
+	for i := range c.shards {
+		reaped = c.shards[i].reap(reaped)
+	}
+	return reaped
+}
+
+// reap removes any closed connections from the shard, appending
+// them to reaped.
+func (s *clientShard) reap(reaped []*conn) []*conn {
+	s.RLock()
+	toDelete := []*conn{}
+	for _, con := range s.clients {
+		if con.isClosed() {
+			toDelete = append(toDelete, con)
 		}
 	}
-	c.RUnlock()
-	c.Lock()
-	for _, k := range toDelete {
-		delete(c.clients, k)
+	s.RUnlock()
+	if len(toDelete) == 0 {
+		return reaped
+	}
+	s.Lock()
+	for _, con := range toDelete {
+		// The ID may have been reused since the read lock was released.
+		if s.clients[con.id] == con {
+			delete(s.clients, con.id)
+			reaped = append(reaped, con)
+		}
 	}
-	c.Unlock()
+	s.Unlock()
+	return reaped
 }
@@ -5,10 +5,13 @@
 
 package ftc
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 func TestClientSetBasic(t *testing.T) {
-	s := &clientSet{clients: map[string]*conn{}}
+	s := newClientSet()
 	c1 := newConn()
 	c2 := newConn()
 	c3 := newConn()
@@ -27,15 +30,42 @@ func TestClientSetBasic(t *testing.T) {
 	if c != nil || s.len() != 2 {
 		t.Errorf("expected conn to be reaped due to being in closed state, got %+v", c)
 	}
-	s.remove(c1)
+	if !s.remove(c1) {
+		t.Errorf("expected conn with ID %s to be present", c1.id)
+	}
 	c = s.get(c1.id)
 	if c != nil || s.len() != 1 {
 		t.Errorf("expected conn with ID %s to be removed, got %+v", c1.id, c)
 	}
 }
 
+func TestAddingDuplicateID(t *testing.T) {
+	s := newClientSet()
+	c1 := newConn()
+	c2 := newConn()
+	c2.id = c1.id
+	if !s.add(c1) {
+		t.Fatal("expected conn to be added")
+	}
+	if s.add(c2) {
+		t.Error("expected conn with duplicate ID to not be added")
+	}
+	if r := s.get(c1.id); r != c1 {
+		t.Errorf("expected original conn to be preserved, got %+v", r)
+	}
+	// A closed conn may be replaced.
+	c1.Close()
+	if !s.add(c2) || s.get(c1.id) != c2 {
+		t.Error("expected conn to replace closed conn with the same ID")
+	}
+	// Removing the replaced conn leaves its successor in place.
+	if s.remove(c1) || s.get(c1.id) != c2 {
+		t.Error("expected removing a replaced conn to leave the set unchanged")
+	}
+}
+
 func TestAddingEmptyID(t *testing.T) {
-	s := &clientSet{clients: map[string]*conn{}}
+	s := newClientSet()
 	c := newConn()
 	c.id = ""
 	s.add(c)
@@ -43,3 +73,30 @@ func TestAddingEmptyID(t *testing.T) {
 		t.Errorf("expected connection with empty id to not be added. got %+v", r)
 	}
 }
+
+func TestClientSetConcurrent(t *testing.T) {
+	s := newClientSet()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c := newConn()
+				s.add(c)
+				if s.get(c.id) != c {
+					t.Errorf("expected conn with ID %s to be in the set", c.id)
+				}
+				if j%2 == 0 {
+					c.Close()
+				}
+				s.reap()
+			}
+		}()
+	}
+	wg.Wait()
+	s.reap()
+	if n := s.len(); n != 400 {
+		t.Errorf("expected set length to be 400, was %d", n)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import "io"
+
+// A PacketType identifies the kind of an FTC packet.
+type PacketType byte
+
+// The types of FTC packets.
+const (
+	PacketOpen    = PacketType(packetTypeOpen)
+	PacketClose   = PacketType(packetTypeClose)
+	PacketPing    = PacketType(packetTypePing)
+	PacketPong    = PacketType(packetTypePong)
+	PacketMessage = PacketType(packetTypeMessage)
+	PacketUpgrade = PacketType(packetTypeUpgrade)
+	PacketNoop    = PacketType(packetTypeNoop)
+)
+
+// A Packet is a single FTC packet, as exchanged with a client.
+type Packet struct {
+	Type PacketType
+	Data []byte
+}
+
+// EncodePacket writes the encoding of p to w, as it is sent over a
+// WebSocket.
+func EncodePacket(w io.Writer, p Packet) error {
+	return newPacketEncoder(w).encode(packet{typ: byte(p.Type), data: p.Data})
+}
+
+// DecodePacket reads a single encoded packet from r. All of r is read;
+// if r is a *websocket.Conn, a single frame is read instead.
+func DecodePacket(r io.Reader) (Packet, error) {
+	var pkt packet
+	if err := newPacketDecoder(r).decode(&pkt); err != nil {
+		return Packet{}, err
+	}
+	return Packet{Type: PacketType(pkt.typ), Data: pkt.data}, nil
+}
+
+// EncodePayload writes the encoding of pkts to w as a single payload,
+// as it is sent over polling.
+func EncodePayload(w io.Writer, pkts []Packet) error {
+	p := make([]packet, len(pkts))
+	for i, pkt := range pkts {
+		p[i] = packet{typ: byte(pkt.Type), data: pkt.Data}
+	}
+	return newPayloadEncoder(w).encode(p)
+}
+
+// DecodePayload reads an encoded payload from r until EOF and returns
+// the packets it holds.
+func DecodePayload(r io.Reader) ([]Packet, error) {
+	var p []packet
+	if err := newPayloadDecoder(r).decode(&p); err != nil {
+		return nil, err
+	}
+	pkts := make([]Packet, len(p))
+	for i, pkt := range p {
+		pkts[i] = Packet{Type: PacketType(pkt.typ), Data: pkt.data}
+	}
+	return pkts, nil
+}
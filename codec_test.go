@@ -0,0 +1,52 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	var buf bytes.Buffer
+	pkt := Packet{Type: PacketMessage, Data: []byte("Foo 世 bar baz 界 qux")}
+	if err := EncodePacket(&buf, pkt); err != nil {
+		t.Fatalf("could not encode packet: %v", err)
+	}
+	if expected := "4Foo 世 bar baz 界 qux"; buf.String() != expected {
+		t.Errorf("output mismatch. expected %q, got %q", expected, buf.String())
+	}
+	decoded, err := DecodePacket(&buf)
+	if err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, pkt) {
+		t.Errorf("expected %+v, got %+v", pkt, decoded)
+	}
+	pkts := []Packet{
+		Packet{Type: PacketPing, Data: []byte("probe")},
+		Packet{Type: PacketUpgrade, Data: []byte{}},
+	}
+	buf.Reset()
+	if err := EncodePayload(&buf, pkts); err != nil {
+		t.Fatalf("could not encode payload: %v", err)
+	}
+	if expected := "6:2probe1:5"; buf.String() != expected {
+		t.Errorf("output mismatch. expected %q, got %q", expected, buf.String())
+	}
+	decodedPkts, err := DecodePayload(&buf)
+	if err != nil {
+		t.Fatalf("could not decode payload: %v", err)
+	}
+	if !reflect.DeepEqual(decodedPkts, pkts) {
+		t.Errorf("expected %+v, got %+v", pkts, decodedPkts)
+	}
+	if _, err := DecodePacket(strings.NewReader("9")); err == nil {
+		t.Error("expected error decoding packet with invalid type")
+	}
+}
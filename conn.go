@@ -6,10 +6,16 @@
 package ftc
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"code.google.com/p/go.net/websocket"
@@ -17,7 +23,137 @@ import (
 	"github.com/golang/glog"
 )
 
-const defaultTimeout = 30 * time.Second
+const (
+	defaultTimeout = 30 * time.Second
+
+	// The number of outgoing messages that can be queued for a
+	// polling client before writes fail with ErrBackpressure.
+	defaultSendQueueSize = 10
+
+	// The number of control packets, such as pongs, that can be
+	// queued for a polling client beyond its send queue, so that a
+	// client that falls behind on messages still gets them.
+	controlQueueSize = 4
+
+	// The number of received messages that can be waiting to be read.
+	defaultRecvQueueSize = 10
+
+	// The number of heartbeat round-trip times averaged by RTT.
+	rttSamples = 5
+)
+
+// ErrBackpressure is returned by Write when the connection’s send
+// queue is full because the client is not keeping up.
+var ErrBackpressure = errors.New("send queue is full")
+
+// ErrReadTimeout is returned by Read when no message is received
+// within the time set by the ReadTimeout option.
+var ErrReadTimeout = errors.New("read timed out")
+
+// ErrMessageTooLarge is returned by Write when a message is larger
+// than the MaxMessageSize option allows.
+var ErrMessageTooLarge = errors.New("message exceeds maximum size")
+
+// errClosing is returned when a message is written to a connection
+// that CloseGracefully is closing.
+var errClosing = errors.New("connection is closing")
+
+// errDeliveryTimeout is returned by onMessage when a received message
+// is not read by the application in time and has to be dropped.
+var errDeliveryTimeout = errors.New("message was not read in time")
+
+// numCloses counts closed connections keyed by their DisconnectReason.
+var numCloses = expvar.NewMap("num_closes")
+
+// Traffic on the server’s connections, in messages and bytes of
+// message data.
+var (
+	numMessagesIn  = expvar.NewInt("num_messages_in")
+	numMessagesOut = expvar.NewInt("num_messages_out")
+	numBytesIn     = expvar.NewInt("num_bytes_in")
+	numBytesOut    = expvar.NewInt("num_bytes_out")
+)
+
+// A DisconnectReason describes why a connection was closed.
+type DisconnectReason int
+
+const (
+	DisconnectServer          DisconnectReason = iota // Closed by the server or application.
+	DisconnectClient                                  // The client sent a close packet.
+	DisconnectTransportError                          // The underlying transport failed.
+	DisconnectPongTimeout                             // The client did not respond to a ping in time.
+	DisconnectHandlerError                            // The handler returned an error or panicked.
+	DisconnectKicked                                  // Disconnected by the server by session ID.
+	DisconnectShutdown                                // The server was shut down.
+	DisconnectIdle                                    // No messages were exchanged within the idle timeout.
+	DisconnectHandlerReturned                         // The handler returned while the connection was open.
+)
+
+var disconnectReasonNames = map[DisconnectReason]string{
+	DisconnectServer:          "server",
+	DisconnectClient:          "client",
+	DisconnectTransportError:  "transport_error",
+	DisconnectPongTimeout:     "pong_timeout",
+	DisconnectHandlerError:    "handler_error",
+	DisconnectKicked:          "kicked",
+	DisconnectShutdown:        "shutdown",
+	DisconnectIdle:            "idle",
+	DisconnectHandlerReturned: "handler_returned",
+}
+
+func (r DisconnectReason) String() string {
+	return disconnectReasonNames[r]
+}
+
+// A CloseError is passed to the OnClose option to describe why a
+// connection was closed.
+type CloseError struct {
+	Reason DisconnectReason
+	Err    error  // The error that caused the close, if any.
+	Data   []byte // The data of the client’s close packet, if any.
+	// Code is the WebSocket close code if the connection closed because
+	// its WebSocket did, or 0 otherwise. It is CloseNormalClosure if the
+	// client closed the WebSocket cleanly and CloseAbnormalClosure if
+	// the WebSocket failed, for instance because its TCP connection was
+	// reset. The websocket package does not report the code that the
+	// client sent, so a client going away, as when the user navigates
+	// from the page, is also reported as CloseNormalClosure.
+	Code int
+}
+
+// The WebSocket close codes reported in a CloseError.
+const (
+	CloseNormalClosure   = 1000
+	CloseAbnormalClosure = 1006
+)
+
+// wsCloseCode returns the WebSocket close code for err, an error
+// reading from a WebSocket, or 0 if err does not come from the
+// WebSocket closing, such as a malformed packet.
+func wsCloseCode(err error) int {
+	if err == io.EOF {
+		// The client sent a close frame or closed the TCP connection
+		// between frames.
+		return CloseNormalClosure
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return CloseAbnormalClosure
+	}
+	return 0
+}
+
+func (e *CloseError) Error() string {
+	if e.Err != nil {
+		return "connection closed (" + e.Reason.String() + "): " + e.Err.Error()
+	}
+	return "connection closed (" + e.Reason.String() + ")"
+}
+
+// Unwrap returns the error that caused the close, if any.
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
 
 // newID returns a pseudo-random, URL-encoded, base64
 // string used for connection identifiers.
@@ -35,47 +171,457 @@ func newID() string {
 
 // Conn represents an FTC connection.
 type Conn struct {
-	c    *conn
-	msgs chan []byte
+	// Traffic counters, updated atomically. They are kept first in
+	// the struct so that they are 64-bit aligned on 32-bit platforms,
+	// and live here rather than on c so that they outlast Close.
+	bytesIn, bytesOut int64
+	msgsIn, msgsOut   int64
+
+	c           *conn // Kept once closed, so that every method stays safe to call.
+	msgs        chan message
+	connectedAt time.Time
+	userAgent   string // The User-Agent of the handshake request.
+	// If set, keeps sent messages until the client acknowledges them.
+	replay *replayBuffer
+	// How long onMessage waits for room in msgs.
+	deliveryTimeout time.Duration
+	done            <-chan struct{} // Closed when the connection is closed.
+
+	pauseMu sync.Mutex
+	resumed chan struct{} // Set while paused; closed by Resume.
+
+	eventsMu sync.RWMutex
+	events   map[string]func([]json.RawMessage) // Event handlers registered by On.
 }
 
 func newPubConn(c *conn) *Conn {
-	return &Conn{c: c, msgs: make(chan []byte, 10)}
+	return &Conn{
+		c:               c,
+		done:            c.done,
+		msgs:            make(chan message, defaultRecvQueueSize),
+		connectedAt:     time.Now(),
+		deliveryTimeout: defaultTimeout,
+	}
 }
 
-func (c *Conn) onMessage(msg []byte) {
+// A message is a message received on a connection.
+type message struct {
+	data   []byte
+	binary bool // Whether it holds binary data.
+}
+
+// onMessage queues msg to be read by the application, noting whether
+// it was binary, unless it is an event with a handler registered by
+// On, which is called instead once the connection is not paused. If
+// msg cannot be queued or dispatched within the delivery timeout, it
+// is dropped and an error is returned. A message received once the
+// connection is closed is dropped too.
+func (c *Conn) onMessage(msg []byte, binary bool) error {
+	c.c.touch()
+	c.countIn(1, int64(len(msg)))
+	t := time.NewTimer(c.deliveryTimeout)
+	defer t.Stop()
+	if !binary {
+		if handler, args := c.eventHandler(msg); handler != nil {
+			if resumed := c.paused(); resumed != nil {
+				select {
+				case <-resumed:
+				case <-c.done:
+					return nil
+				case <-t.C:
+					c.c.warningf("event was not dispatched in time")
+					return errDeliveryTimeout
+				}
+			}
+			handler(args)
+			return nil
+		}
+	}
 	select {
-	case c.msgs <- msg:
-		glog.Infoln("sent message to msgs chan:", string(msg))
-		return
-	case <-time.After(defaultTimeout):
-		glog.Warningln("onMessage timed out")
+	case c.msgs <- message{msg, binary}:
+		c.c.infof("sent message to msgs chan: %s", msg)
+		return nil
+	case <-c.done:
+		c.c.infof("dropping message received after close: %s", msg)
+		return nil
+	case <-t.C:
+		c.c.warningf("onMessage timed out")
+		return errDeliveryTimeout
 	}
 }
 
+// Read copies the next message received on the connection into p.
+// Each call reads one message; if the message is longer than p, the
+// rest of it is discarded. Use ReadMessage to read messages whose size
+// is not known in advance.
 func (c *Conn) Read(p []byte) (int, error) {
-	// TODO(andybons): if the connection is closed, return io.EOF.
-	return copy(p, <-c.msgs), nil
+	msg, err := c.ReadMessage()
+	return copy(p, msg), err
+}
+
+// ReadMessage returns the next message received on the connection in
+// its entirety. The returned slice belongs to the caller. It blocks
+// until a message is received, or returns ErrReadTimeout if the
+// ReadTimeout option is set and it elapses first. It returns io.EOF
+// once the connection is closed. While the connection is paused, it
+// blocks until Resume is called or the connection is closed.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	msg, _, err := c.ReadFrame()
+	return msg, err
 }
 
+// ReadFrame is like ReadMessage, but also reports whether the message
+// is binary, as clients send binary data such as ArrayBuffers: either
+// in a binary WebSocket frame or, over polling and from clients that
+// cannot send binary frames, base64-encoded with a "b" prefix.
+func (c *Conn) ReadFrame() (msg []byte, binary bool, err error) {
+	var timeout <-chan time.Time
+	if c.c.readTimeout > 0 {
+		t := time.NewTimer(c.c.readTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	if resumed := c.paused(); resumed != nil {
+		select {
+		case <-resumed:
+		case <-c.done:
+		case <-timeout:
+			return nil, false, ErrReadTimeout
+		}
+	}
+	select {
+	case m := <-c.msgs:
+		return m.data, m.binary, nil
+	case <-c.done:
+		// Messages received before the close are still read.
+		select {
+		case m := <-c.msgs:
+			return m.data, m.binary, nil
+		default:
+			return nil, false, io.EOF
+		}
+	case <-timeout:
+		return nil, false, ErrReadTimeout
+	}
+}
+
+// Pause stops messages received on the connection from being read
+// until Resume is called. Messages received meanwhile wait in the
+// receive queue; once it is full, the server waits for room as it does
+// for any handler that falls behind, closing the connection if no room
+// is made in time. See the RecvQueueSize option. Events with a handler
+// registered by On are not dispatched until Resume either; the server
+// waits for it, as for room in a full queue, before handling anything
+// else the client sends.
+func (c *Conn) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+// paused returns a channel that is closed once the connection is
+// resumed, or nil if it is not paused.
+func (c *Conn) paused() <-chan struct{} {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	return c.resumed
+}
+
+// Resume lets the messages received while the connection was paused
+// be read, in the order they were received.
+func (c *Conn) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// Write sends p to the client as a single message. If the client is
+// polling and its send queue is full, Write returns ErrBackpressure
+// immediately so that the caller can decide how to handle a slow client.
+//
+// Messages are delivered in the order they are written, including
+// across an upgrade from polling to WebSocket: messages still queued
+// for polling are sent over the WebSocket before any written after
+// the upgrade.
 func (c *Conn) Write(p []byte) (int, error) {
-	pkt := packet{typ: packetTypeMessage, data: p}
-	c.c.mu.RLock()
-	defer c.c.mu.RUnlock()
-	if c.c.ws != nil {
-		return len(p), newPacketEncoder(c.c).encode(pkt)
+	if max := c.c.maxMessageSize; max > 0 && int64(len(p)) > max {
+		return 0, ErrMessageTooLarge
 	}
-	return len(p), newPayloadEncoder(c.c).encode([]packet{pkt})
+	if err := c.c.writePacket(packet{typ: packetTypeMessage, data: p}); err != nil {
+		return 0, err
+	}
+	c.c.touch()
+	c.countOut(1, int64(len(p)))
+	return len(p), nil
 }
 
-// Close closes the connection.
+// WriteBatch sends msgs to the client as consecutive messages, with no
+// other write interleaved between them. A polling client receives them
+// in a single payload, which takes one place in the send queue. It
+// returns ErrMessageTooLarge, without sending anything, if any message
+// is larger than the MaxMessageSize option allows.
+func (c *Conn) WriteBatch(msgs [][]byte) error {
+	pkts := make([]packet, len(msgs))
+	var n int64
+	for i, msg := range msgs {
+		if max := c.c.maxMessageSize; max > 0 && int64(len(msg)) > max {
+			return ErrMessageTooLarge
+		}
+		pkts[i] = packet{typ: packetTypeMessage, data: msg}
+		n += int64(len(msg))
+	}
+	if err := c.c.writePackets(pkts); err != nil {
+		return err
+	}
+	c.c.touch()
+	c.countOut(int64(len(msgs)), n)
+	return nil
+}
+
+// WriteBinary is like Write, but sends p as binary data. Upgraded
+// clients receive it in a binary WebSocket frame; polling clients, and
+// clients that asked for base64 with the b64 handshake parameter,
+// receive it base64-encoded. ReadFrame reports it as binary on the
+// client.
+func (c *Conn) WriteBinary(p []byte) (int, error) {
+	if max := c.c.maxMessageSize; max > 0 && int64(len(p)) > max {
+		return 0, ErrMessageTooLarge
+	}
+	if err := c.c.writePacket(packet{typ: packetTypeMessage, data: p, binary: true}); err != nil {
+		return 0, err
+	}
+	c.c.touch()
+	c.countOut(1, int64(len(p)))
+	return len(p), nil
+}
+
+// WriteString is like Write, but sends the contents of s.
+func (c *Conn) WriteString(s string) (int, error) {
+	return c.Write([]byte(s))
+}
+
+// ConnStats describes the traffic on a connection since it was
+// established. Byte counts include message data only.
+type ConnStats struct {
+	BytesIn     int64     // Bytes of message data received.
+	BytesOut    int64     // Bytes of message data sent.
+	MessagesIn  int64     // Messages received.
+	MessagesOut int64     // Messages sent.
+	ConnectedAt time.Time // When the connection was established.
+}
+
+// countIn records msgs messages totalling n bytes received.
+func (c *Conn) countIn(msgs, n int64) {
+	atomic.AddInt64(&c.msgsIn, msgs)
+	atomic.AddInt64(&c.bytesIn, n)
+	if c.c.metrics {
+		numMessagesIn.Add(msgs)
+		numBytesIn.Add(n)
+	}
+}
+
+// countOut records msgs messages totalling n bytes sent.
+func (c *Conn) countOut(msgs, n int64) {
+	atomic.AddInt64(&c.msgsOut, msgs)
+	atomic.AddInt64(&c.bytesOut, n)
+	if c.c.metrics {
+		numMessagesOut.Add(msgs)
+		numBytesOut.Add(n)
+	}
+}
+
+// Stats returns the traffic counters for the connection. It is safe
+// to call at any time, including after the connection is closed.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		BytesIn:     atomic.LoadInt64(&c.bytesIn),
+		BytesOut:    atomic.LoadInt64(&c.bytesOut),
+		MessagesIn:  atomic.LoadInt64(&c.msgsIn),
+		MessagesOut: atomic.LoadInt64(&c.msgsOut),
+		ConnectedAt: c.connectedAt,
+	}
+}
+
+// QueueDepth returns the number of payloads waiting in the send queue
+// for a polling client’s next poll, and the number of messages received
+// but not yet read. A payload holds a single message unless it was
+// written by WriteBatch. The send queue is empty once the connection
+// has been upgraded. Compare them with the SendQueueSize and
+// RecvQueueSize options to detect a slow client or application.
+func (c *Conn) QueueDepth() (send, recv int) {
+	return c.c.queued(), len(c.msgs)
+}
+
+// Transport returns the name of the transport the connection is
+// using: "websocket" once it has been upgraded, "polling" otherwise.
+func (c *Conn) Transport() string {
+	if c.Upgraded() {
+		return transportWebSocket
+	}
+	return transportPolling
+}
+
+// Upgraded reports whether the connection has been upgraded to a
+// WebSocket transport.
+func (c *Conn) Upgraded() bool {
+	return c.c.upgraded()
+}
+
+// Ack discards the messages with sequence numbers up to and including
+// seq from the connection’s replay buffer, once the client has told the
+// application that it received them. The nth message written to a
+// connection has sequence number n, so a client can number messages by
+// counting them. Ack does nothing unless the ReplayBufferSize option is
+// set.
+func (c *Conn) Ack(seq uint64) {
+	if c.replay != nil {
+		c.replay.ack(seq)
+	}
+}
+
+// Unacked returns the messages in the connection’s replay buffer, oldest
+// first, and the sequence number of the oldest. An application can send
+// them on the client’s new connection when it reconnects; if seq is past
+// the last message the client acknowledged, messages have been dropped
+// from the buffer and the client must resynchronize another way. It is
+// safe to call at any time, including after the connection is closed.
+func (c *Conn) Unacked() (seq uint64, msgs [][]byte) {
+	if c.replay == nil {
+		return 0, nil
+	}
+	return c.replay.unacked()
+}
+
+// UserAgent returns the User-Agent header of the request that opened
+// the connection, or "" if it had none. It is safe to call at any
+// time, including after the connection is closed.
+func (c *Conn) UserAgent() string {
+	return c.userAgent
+}
+
+// Closed reports whether the connection has been closed, by either
+// end or by the server.
+func (c *Conn) Closed() bool {
+	return c.c.isClosed()
+}
+
+// Done returns a channel that is closed once the connection is closed,
+// by either end or by the server. A Handler that hands the connection
+// to other goroutines can wait on it before returning, since the
+// connection is closed once the Handler returns.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// RTT returns the round-trip time to the client, averaged over the
+// last few pings sent by the server, or 0 if it has not been measured
+// yet. For a polling client it includes any wait for the next poll.
+func (c *Conn) RTT() time.Duration {
+	return c.c.rtt()
+}
+
+// Join adds the connection to the named room, so that it receives the
+// messages sent to the room with the server’s BroadcastTo. The
+// connection leaves every room when it is closed.
+func (c *Conn) Join(room string) {
+	if c.c.rooms != nil && !c.c.isClosed() {
+		c.c.rooms.join(room, c.c)
+	}
+}
+
+// Leave removes the connection from the named room.
+func (c *Conn) Leave(room string) {
+	if c.c.rooms != nil {
+		c.c.rooms.leave(room, c.c)
+	}
+}
+
+// Poke sends a noop packet to a polling client so that its pending
+// GET returns at once, prompting it to poll again, for instance to
+// re-evaluate its transport. It does nothing once the connection has
+// been upgraded or closed.
+func (c *Conn) Poke() {
+	if err := c.c.poke(); err != nil {
+		c.c.warningf("could not poke connection: %v", err)
+	}
+}
+
+// Flush blocks until every message written to the connection has been
+// handed to the client by a poll, or until ctx is done. Once the
+// connection has been upgraded, writes are sent immediately and Flush
+// returns right away.
+func (c *Conn) Flush(ctx context.Context) error {
+	for {
+		// Fetch the channel first so that a poll emptying buf in
+		// between cannot be missed.
+		drained := c.c.drained()
+		if c.c.isClosed() {
+			return errors.New("cannot flush closed connection")
+		}
+		if c.c.upgraded() || c.c.queued() == 0 {
+			return nil
+		}
+		select {
+		case <-drained:
+		case <-c.c.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CloseGracefully stops the connection accepting messages, waits, as
+// Flush does, for those already written to be handed to the client,
+// and then sends the client a close packet and closes the connection.
+// If ctx is done first, the connection is closed at once and ctx’s
+// error is returned.
+func (c *Conn) CloseGracefully(ctx context.Context) error {
+	if c.c.isClosed() {
+		return nil
+	}
+	c.c.mu.Lock()
+	c.c.closing = true
+	c.c.mu.Unlock()
+	if err := c.Flush(ctx); err != nil {
+		c.Close()
+		return err
+	}
+	return closeWithPacket(c.c, DisconnectServer, nil, nil)
+}
+
+// Close closes the connection. Closing a connection that is already
+// closed does nothing.
 func (c *Conn) Close() error {
-	var err error
-	if c.c != nil {
-		err = c.c.Close()
-		c.c = nil
+	if c.c.isClosed() {
+		return nil
 	}
-	return err
+	return c.c.Close()
+}
+
+// CloseWithReason sends the client a close packet holding code and msg
+// as JSON, in the same form as the server’s HTTP errors, and closes the
+// connection, so that the client can tell the user why. If msg is
+// empty, the standard message for code is used, if it has one.
+func (c *Conn) CloseWithReason(code int, msg string) error {
+	if c.c.isClosed() {
+		return nil
+	}
+	if len(msg) == 0 {
+		msg = errorMessage[code]
+	}
+	data, err := json.Marshal(struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{code, msg})
+	if err != nil {
+		return err
+	}
+	return closeWithPacket(c.c, DisconnectServer, nil, data)
 }
 
 // conn represents an internal FTC connection.
@@ -88,89 +634,634 @@ func (c *Conn) Close() error {
 // a buffered channel by a POST to be read later by
 // a subsequent GET.
 type conn struct {
-	id      string      // A unique ID assigned to the conn.
-	buf     chan []byte // Storage buffer for messages.
-	pubConn *Conn       // Public connection that only reads and writes message data.
+	// When the conn last exchanged a message or received a ping, in
+	// Unix nanoseconds, updated atomically. It is kept first in the
+	// struct so that it is 64-bit aligned on 32-bit platforms.
+	lastActivity int64
 
-	mu     sync.RWMutex    // Protects the items below.
-	ws     *websocket.Conn // If upgraded, used to send and receive messages.
-	closed bool            // Whether the connection is closed.
+	id      string             // A unique ID assigned to the conn.
+	buf     chan []byte        // Storage buffer for messages.
+	pubConn *Conn              // Public connection that only reads and writes message data.
+	logger  Logger             // Receives log output about the conn.
+	reapc   chan<- *conn       // If set, notified when the conn closes.
+	done    chan struct{}      // Closed when the conn is closed.
+	alive   chan struct{}      // Signaled when the client responds to a ping.
+	onClose func(*Conn, error) // If set, called once the conn has closed.
+
+	// How long a poll waits for more payloads to send along with
+	// the first one it receives.
+	coalesce time.Duration
+	// The number of message payloads buf holds before writes fail
+	// with ErrBackpressure. Control packets may fill the rest of it.
+	sendQueueSize int
+	// The largest message that may be written, or 0 for no limit.
+	maxMessageSize int64
+	// How long Read waits for a message, or 0 to wait indefinitely.
+	readTimeout time.Duration
+	// How long a write to the WebSocket may take, or 0 for no limit.
+	writeTimeout time.Duration
+	// If set, the rooms the conn may join; it leaves them on close.
+	rooms *roomSet
+	// Whether the conn’s traffic is counted in the server’s expvars.
+	metrics bool
+	// Whether the client asked, with the b64 handshake parameter, for
+	// binary data to be sent base64-encoded for the conn’s lifetime,
+	// even once upgraded to a WebSocket, which could carry it as is.
+	forceBase64 bool
+
+	wmu sync.Mutex // Serializes writes to the underlying transport.
+	pmu sync.Mutex // Serializes polls so that payloads are delivered in order.
+
+	mu        sync.RWMutex              // Protects the items below.
+	ws        *websocket.Conn           // If upgraded, used to send and receive messages.
+	closed    bool                      // Whether the connection is closed.
+	closing   bool                      // Whether messages can no longer be written.
+	polling   bool                      // Whether a GET poll is in progress.
+	fields    map[string]interface{}    // Fields attached to log lines about the conn.
+	drainc    chan struct{}             // If set, closed once buf is next emptied.
+	unsent    []byte                    // A payload taken from buf that a poll failed to deliver.
+	closeData []byte                    // Data for the close packet sent to a polling client.
+	rtts      [rttSamples]time.Duration // The latest round-trip times measured by the heartbeat.
+	nrtts     int                       // The number of round-trip times ever measured.
 }
 
 // newConn allocates and returns a new FTC connection.
 func newConn() *conn {
 	c := &conn{
-		id:  newID(),
-		buf: make(chan []byte, 10),
+		id:            newID(),
+		buf:           make(chan []byte, defaultSendQueueSize+controlQueueSize),
+		sendQueueSize: defaultSendQueueSize,
+		done:          make(chan struct{}),
+		alive:         make(chan struct{}, 1),
+		logger:        glogLogger{},
 	}
 	c.pubConn = newPubConn(c)
+	c.touch()
 	return c
 }
 
 // Read copies the next available message to the given
 // byte slice. If no message is available, it will block.
+// Once the connection is closed and any buffered messages
+// have been read, Read returns io.EOF.
 func (c *conn) Read(p []byte) (int, error) {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
-	if c.closed {
-		return 0, errors.New("cannot read on closed connection")
+	ws := c.ws
+	c.mu.RUnlock()
+	if ws != nil {
+		return ws.Read(p)
 	}
-	if c.ws != nil {
-		return c.ws.Read(p)
+	b, err := c.next()
+	return copy(p, b), err
+}
+
+// next returns the next message buffered for a polling client.
+// It blocks until a message is available or the connection is
+// closed (io.EOF). It never reads from an upgraded connection’s
+// WebSocket.
+func (c *conn) next() ([]byte, error) {
+	return c.nextContext(context.Background())
+}
+
+// nextContext is like next but also returns if ctx is done first,
+// in which case no message is taken from the buffer.
+func (c *conn) nextContext(ctx context.Context) ([]byte, error) {
+	c.mu.Lock()
+	b := c.unsent
+	c.unsent = nil
+	c.mu.Unlock()
+	if b != nil {
+		return b, nil
 	}
 	select {
-	case b := <-c.buf:
-		return copy(p, b), io.EOF
-	case <-time.After(defaultTimeout):
-		return 0, errors.New("timeout")
+	case b, ok := <-c.buf:
+		if !ok {
+			return nil, io.EOF
+		}
+		if len(c.buf) == 0 {
+			c.notifyDrained()
+		}
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// poll passes the next buffered payload to deliver, as next does.
+// If ctx is done before deliver is called, or deliver fails, the
+// payload is kept and is the first to be delivered by the next poll.
+// Polls are serialized, so payloads are delivered in the order they
+// were written, and a poll that is abandoned while waiting does not
+// lose any.
+func (c *conn) poll(ctx context.Context, deliver func([]byte) error) error {
+	c.pmu.Lock()
+	defer c.pmu.Unlock()
+	// Release the poll in time for the client to make another before
+	// proxies give up on the request.
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	b, err := c.nextContext(ctx)
+	if err != nil {
+		return err
+	}
+	if c.coalesce > 0 {
+		select {
+		case <-time.After(c.coalesce):
+		case <-ctx.Done():
+		case <-c.done:
+		}
+	}
+	b = c.drain(b)
+	if err = ctx.Err(); err == nil {
+		err = deliver(b)
+	}
+	if err != nil {
+		c.requeue(b)
+	}
+	return err
+}
+
+// requeue keeps a payload that could not be delivered to a poll so it
+// is sent first on the next one. If the conn was upgraded while the
+// poll was being answered, the upgrade has already flushed buf and no
+// poll will follow, so the payload is written to the WebSocket instead.
+func (c *conn) requeue(b []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	c.unsent = b
+	c.mu.Unlock()
+	if c.upgraded() {
+		c.flushBuffer()
+	}
+}
+
+// drain appends every payload waiting in buf to b, so that they can
+// be sent to a polling client in a single response.
+func (c *conn) drain(b []byte) []byte {
+	for {
+		select {
+		case next, ok := <-c.buf:
+			if !ok {
+				return b
+			}
+			// Copy rather than append to the first payload in place.
+			b = append(b[:len(b):len(b)], next...)
+		default:
+			c.notifyDrained()
+			return b
+		}
+	}
+}
+
+// beginPoll marks a GET poll as in progress, returning false if one
+// already is.
+func (c *conn) beginPoll() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.polling {
+		return false
+	}
+	c.polling = true
+	return true
+}
+
+// endPoll marks the GET poll begun by beginPoll as finished.
+func (c *conn) endPoll() {
+	c.mu.Lock()
+	c.polling = false
+	c.mu.Unlock()
+}
+
+// queued returns the number of payloads waiting to be sent to a
+// polling client.
+func (c *conn) queued() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := len(c.buf)
+	if c.unsent != nil {
+		n++
 	}
+	return n
 }
 
 // Write writes the contents of p as a single message to
-// the connection. This call may block if the number of
-// outstanding writes exceeds the size of buf.
+// the connection. If the connection has not been upgraded and
+// buf is full, Write returns ErrBackpressure without blocking.
 func (c *conn) Write(p []byte) (int, error) {
-	glog.Infof("writing %q (upgraded: %t)", p, c.upgraded())
+	return c.write(p, websocket.TextFrame)
+}
+
+// write is like Write, but sends p to an upgraded client in a frame of
+// the given payload type.
+func (c *conn) write(p []byte, payloadType byte) (int, error) {
+	c.infof("writing %q (upgraded: %t)", p, c.upgraded())
 	c.mu.RLock()
-	defer c.mu.RUnlock()
 	if c.closed {
+		c.mu.RUnlock()
 		return 0, errors.New("cannot write on closed connection")
 	}
-	if c.ws != nil {
-		return c.ws.Write(p)
+	ws := c.ws
+	if ws == nil {
+		defer c.mu.RUnlock()
+		select {
+		case c.buf <- p:
+			return len(p), nil
+		default:
+			return 0, ErrBackpressure
+		}
 	}
-	select {
-	case c.buf <- p:
-		return len(p), nil
-	case <-time.After(defaultTimeout):
-		return 0, errors.New("timeout")
+	// mu is released before the write, which may block on a client that
+	// has stopped reading; closing the conn needs mu and is what ends
+	// such a write. Writes to ws are serialized by wmu.
+	c.mu.RUnlock()
+	if c.writeTimeout > 0 {
+		ws.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if payloadType != websocket.TextFrame {
+		// Frames are written with the connection’s payload type, so it
+		// is switched for this frame and back for the packets that
+		// follow.
+		ws.PayloadType = payloadType
+		defer func() { ws.PayloadType = websocket.TextFrame }()
+	}
+	n, err := ws.Write(p)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		// Part of the frame may have been written, so the WebSocket
+		// cannot be used again. The caller may hold wmu, which the
+		// onClose hook could need, so the conn is closed separately.
+		go c.close(DisconnectTransportError, err)
+	}
+	return n, err
+}
+
+// writePacket encodes pkt for the connection’s current transport
+// and writes it as a single message. Writes are serialized so that
+// packets from different goroutines are never interleaved.
+func (c *conn) writePacket(pkt packet) error {
+	return c.writePackets([]packet{pkt})
+}
+
+// writePackets writes pkts with no other write interleaved between
+// them: as one payload to a polling client, or as consecutive
+// messages on a WebSocket.
+func (c *conn) writePackets(pkts []packet) error {
+	if len(pkts) == 0 {
+		return nil
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if pkts[0].typ == packetTypeMessage && c.isClosing() {
+		return errClosing
+	}
+	var buf bytes.Buffer
+	if !c.upgraded() {
+		// Only messages are subject to the send queue’s limit.
+		if pkts[0].typ == packetTypeMessage && len(c.buf) >= c.sendQueueSize {
+			return ErrBackpressure
+		}
+		if err := newPayloadEncoder(&buf).encode(pkts); err != nil {
+			return err
+		}
+		if _, err := c.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		for _, pkt := range pkts {
+			c.record(pkt)
+		}
+		return nil
+	}
+	// TODO: Send the frames in a single write once the websocket
+	// package allows it. It flushes each frame to the connection
+	// itself and does not expose the connection or its buffer size.
+	enc := newPacketEncoder(&buf)
+	for _, pkt := range pkts {
+		if pkt.binary && !c.forceBase64 {
+			if _, err := c.write(pkt.data, websocket.BinaryFrame); err != nil {
+				return err
+			}
+			c.record(pkt)
+			continue
+		}
+		buf.Reset()
+		enc.reset()
+		if err := enc.encode(pkt); err != nil {
+			return err
+		}
+		if _, err := c.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		c.record(pkt)
+	}
+	return nil
+}
+
+// poke queues a noop packet for a polling client. wmu is held so that
+// the noop cannot be sent over a WebSocket that upgrades concurrently.
+func (c *conn) poke() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.upgraded() || c.isClosed() {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := newPayloadEncoder(&buf).encode([]packet{{typ: packetTypeNoop}}); err != nil {
+		return err
+	}
+	_, err := c.Write(buf.Bytes())
+	return err
+}
+
+// record adds pkt to the replay buffer, if there is one and pkt is a
+// message. The caller must hold wmu, so that messages are recorded in
+// the order they were written.
+func (c *conn) record(pkt packet) {
+	if pkt.typ == packetTypeMessage && c.pubConn.replay != nil {
+		c.pubConn.replay.add(pkt.data)
 	}
 }
 
 // Close closes the connection.
 func (c *conn) Close() error {
+	return c.close(DisconnectServer, nil)
+}
+
+// close closes the connection and records the reason it was closed.
+// err is the error that caused the close, if any. Both are passed to
+// the conn’s onClose hook as a *CloseError.
+func (c *conn) close(reason DisconnectReason, err error) error {
+	return c.closeWithError(&CloseError{Reason: reason, Err: err})
+}
+
+// closeWithError is like close, but passes e, which may also hold the
+// data of the client’s close packet or a WebSocket close code, to the
+// onClose hook.
+func (c *conn) closeWithError(e *CloseError) error {
+	reason := e.Reason
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	if c.closed {
+		c.mu.Unlock()
 		return errors.New("connection is already closed")
 	}
+	// Let a polling client know that the connection was closed
+	// rather than leaving it to time out on its next poll.
+	queued := c.ws == nil && reason != DisconnectClient && reason != DisconnectTransportError && c.bufferClose()
 	close(c.buf)
-	close(c.pubConn.msgs)
+	// msgs is left open, since a message may still be on its way
+	// to onMessage; readers see done instead.
+	close(c.done)
+	if c.metrics {
+		if c.ws != nil {
+			numClientsByTransport.Add(transportWebSocket, -1)
+		} else {
+			numClientsByTransport.Add(transportPolling, -1)
+		}
+	}
 	if c.ws != nil {
 		c.ws.Close()
 	}
 	c.closed = true
+	c.mu.Unlock()
+	numCloses.Add(reason.String(), 1)
+	if c.rooms != nil {
+		c.rooms.leaveAll(c)
+	}
+	if !queued {
+		// A conn with a queued close packet stays in the client set
+		// until a poll delivers the packet or the next sweep.
+		c.reap()
+	}
+	if c.onClose != nil {
+		c.onClose(c.pubConn, e)
+	}
 	return nil
 }
 
-// upgrade assigns the given WebSocket connection to
-// the connection.
-// TODO(andybons): Flush any messages waiting in buf and close it.
-func (c *conn) upgrade(ws *websocket.Conn) {
-	glog.Infoln("upgrading connection...")
+// bufferClose queues a close packet to be sent to a polling client,
+// returning true if it was queued. If buf is full, the packet is
+// dropped and the client will find out when its next poll fails.
+// It must be called with mu held.
+func (c *conn) bufferClose() bool {
+	var b bytes.Buffer
+	if err := newPayloadEncoder(&b).encode([]packet{packet{typ: packetTypeClose, data: c.closeData}}); err != nil {
+		return false
+	}
+	select {
+	case c.buf <- b.Bytes():
+		return true
+	default:
+		return false
+	}
+}
+
+// reap asks the server to remove the closed conn from its client set.
+func (c *conn) reap() {
+	select {
+	case c.reapc <- c:
+	default:
+		// The reaper will find the conn during its next sweep.
+	}
+}
+
+// touch records activity on the conn.
+func (c *conn) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// idle returns how long it has been since the conn’s last activity.
+func (c *conn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity)))
+}
+
+// heard records that the client has shown it is still alive by
+// sending a pong or a ping of its own.
+func (c *conn) heard() {
+	select {
+	case c.alive <- struct{}{}:
+	default:
+	}
+}
+
+// addRTT records a round-trip time measured by the heartbeat,
+// replacing the oldest sample once there are rttSamples of them.
+func (c *conn) addRTT(d time.Duration) {
 	c.mu.Lock()
+	c.rtts[c.nrtts%rttSamples] = d
+	c.nrtts++
+	c.mu.Unlock()
+}
+
+// rtt returns the mean of the recorded round-trip times, or 0 if
+// none have been recorded.
+func (c *conn) rtt() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := c.nrtts
+	if n > rttSamples {
+		n = rttSamples
+	}
+	if n == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range c.rtts[:n] {
+		sum += d
+	}
+	return sum / time.Duration(n)
+}
+
+// heartbeat pings the client every interval and closes the
+// connection if no response arrives within timeout. It returns
+// once the connection is closed.
+func (c *conn) heartbeat(interval, timeout time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-c.done:
+			return
+		}
+		// Only a response to this ping counts.
+		select {
+		case <-c.alive:
+		default:
+		}
+		sent := time.Now()
+		if err := c.writePacket(packet{typ: packetTypePing}); err != nil {
+			c.errorf("could not send ping: %v", err)
+		}
+		select {
+		case <-c.alive:
+			c.addRTT(time.Since(sent))
+		case <-time.After(timeout):
+			c.warningf("no pong received within %v", timeout)
+			c.close(DisconnectPongTimeout, nil)
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// keepalive sends a WebSocket ping frame every interval until the
+// connection is closed. The WebSocket library answers pings and
+// discards pongs itself, so none are awaited here; the heartbeat
+// detects unresponsive clients.
+func (c *conn) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		if err := c.writePing(); err != nil {
+			c.errorf("could not send websocket ping: %v", err)
+		}
+	}
+}
+
+// writePing sends a ping control frame on the connection’s WebSocket.
+func (c *conn) writePing() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.isClosed() || !c.upgraded() {
+		return nil
+	}
+	_, err := c.write(nil, websocket.PingFrame)
+	return err
+}
+
+// upgrade assigns the given WebSocket connection to the connection.
+//
+// The cutover is performed while holding the write lock: once ws is
+// set, any messages still waiting in buf are moved onto the WebSocket
+// before other writes are allowed. Each message is therefore delivered
+// exactly once, either to a polling GET that received it before the
+// upgrade or over the WebSocket, and never on both.
+//
+// It returns true if the connection was previously using polling.
+func (c *conn) upgrade(ws *websocket.Conn) bool {
+	c.infof("upgrading connection...")
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	first := c.ws == nil
 	c.ws = ws
+	if first && c.metrics && !c.closed {
+		numClientsByTransport.Add(transportPolling, -1)
+		numClientsByTransport.Add(transportWebSocket, 1)
+	}
+	c.mu.Unlock()
+	c.flushBuffer()
+	c.notifyDrained()
+	return first
+}
+
+// flushBuffer writes any payloads waiting in buf to the WebSocket,
+// dropping noop packets that only matter to polling clients. The
+// caller must hold wmu.
+func (c *conn) flushBuffer() {
+	enc := newPacketEncoder(c.ws)
+	c.mu.Lock()
+	b := c.unsent
+	c.unsent = nil
 	c.mu.Unlock()
+	for {
+		if b == nil {
+			select {
+			case next, ok := <-c.buf:
+				if !ok {
+					return
+				}
+				b = next
+			default:
+				return
+			}
+		}
+		var payload []packet
+		if err := newPayloadDecoder(bytes.NewReader(b)).decode(&payload); err != nil {
+			c.errorf("could not decode buffered payload: %v", err)
+		}
+		b = nil
+		for _, pkt := range payload {
+			if pkt.typ == packetTypeNoop {
+				continue
+			}
+			if pkt.binary && !c.forceBase64 {
+				if _, err := c.write(pkt.data, websocket.BinaryFrame); err != nil {
+					c.errorf("could not flush buffered packet: %v", err)
+					return
+				}
+				continue
+			}
+			if err := enc.encode(pkt); err != nil {
+				c.errorf("could not flush buffered packet: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// drained returns a channel that is closed once buf has been emptied,
+// either by a poll or by an upgrade.
+func (c *conn) drained() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.drainc == nil {
+		c.drainc = make(chan struct{})
+	}
+	return c.drainc
+}
+
+// notifyDrained wakes anyone waiting for buf to be emptied.
+func (c *conn) notifyDrained() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.drainc != nil {
+		close(c.drainc)
+		c.drainc = nil
+	}
 }
 
 // upgraded returns true if the connection has been upgraded.
@@ -179,3 +1270,18 @@ func (c *conn) upgraded() bool {
 	defer c.mu.RUnlock()
 	return c.ws != nil
 }
+
+// isClosing reports whether CloseGracefully has begun closing the
+// connection.
+func (c *conn) isClosing() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closing
+}
+
+// isClosed returns true if the connection has been closed.
+func (c *conn) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
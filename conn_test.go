@@ -7,8 +7,17 @@ package ftc
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
+	"net"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
 )
 
 type nopWriter struct{ io.Writer }
@@ -33,8 +42,33 @@ func TestReadWrite(t *testing.T) {
 	}
 }
 
+func TestReadMultipleMessages(t *testing.T) {
+	c := newConn()
+	msgs := [][]byte{[]byte("hello"), []byte("world")}
+	for _, msg := range msgs {
+		if _, err := c.Write(msg); err != nil {
+			t.Fatalf("error writing to conn: %v", err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("problem closing connection: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, c); err != nil {
+		t.Fatalf("error copying from conn: %v", err)
+	}
+	// Closing the conn queues a close packet for the polling client.
+	expected := append(bytes.Join(msgs, nil), "1:1"...)
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("expected read to be %q, got %q", expected, buf.Bytes())
+	}
+}
+
 func TestClosedConnection(t *testing.T) {
 	c1 := newConn()
+	if c1.pubConn.Closed() {
+		t.Error("expected a new connection not to be closed")
+	}
 	if err := c1.Close(); err != nil {
 		t.Fatalf("problem closing connection: %v", err)
 	}
@@ -44,6 +78,9 @@ func TestClosedConnection(t *testing.T) {
 	}
 	for _, c := range []*conn{c1, c2} {
 		b := make([]byte, 5)
+		if n, err := c.Read(b); err != nil || string(b[:n]) != "1:1" {
+			t.Errorf("expected a close packet to be read from closed conn, got %q (%v)", b[:n], err)
+		}
 		if n, err := c.Read(b); err == nil || n != 0 {
 			t.Errorf("expected zero bytes read and error due to closed conn. read %d bytes.", n)
 		}
@@ -54,4 +91,485 @@ func TestClosedConnection(t *testing.T) {
 	if err := c2.Close(); err == nil {
 		t.Error("expected error from closing closed connection")
 	}
+	// c1 was closed internally and c2 through its public Conn, which
+	// stays safe to use.
+	for _, c := range []*Conn{c1.pubConn, c2.pubConn} {
+		if !c.Closed() {
+			t.Error("expected the connection to be closed")
+		}
+		select {
+		case <-c.Done():
+		default:
+			t.Error("expected Done to be closed")
+		}
+		if _, err := c.WriteString("hello"); err == nil {
+			t.Error("expected error writing to closed connection")
+		}
+		if err := c.onMessage([]byte("hello"), false); err != nil {
+			t.Errorf("expected a message received after close to be dropped, got %v", err)
+		}
+		if err := c.Close(); err != nil {
+			t.Errorf("expected closing a closed connection to do nothing, got %v", err)
+		}
+	}
+}
+
+func numClosesFor(reason DisconnectReason) int64 {
+	if v, ok := numCloses.Get(reason.String()).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestWSCloseCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{io.EOF, CloseNormalClosure},
+		{io.ErrUnexpectedEOF, CloseAbnormalClosure},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, CloseAbnormalClosure},
+		{errPacketTooLarge, 0},
+		{fmt.Errorf("invalid packet type %q", 'x'), 0},
+	} {
+		if code := wsCloseCode(tc.err); code != tc.code {
+			t.Errorf("%v: expected close code %d, got %d", tc.err, tc.code, code)
+		}
+	}
+}
+
+func TestCloseReasonCounters(t *testing.T) {
+	before := numClosesFor(DisconnectPongTimeout)
+	otherBefore := numClosesFor(DisconnectClient)
+	c := newConn()
+	if err := c.close(DisconnectPongTimeout, nil); err != nil {
+		t.Fatalf("problem closing connection: %v", err)
+	}
+	if err := c.close(DisconnectPongTimeout, nil); err == nil {
+		t.Error("expected error from closing closed connection")
+	}
+	if n := numClosesFor(DisconnectPongTimeout) - before; n != 1 {
+		t.Errorf("expected %s counter to increase by 1, increased by %d", DisconnectPongTimeout, n)
+	}
+	if n := numClosesFor(DisconnectClient) - otherBefore; n != 0 {
+		t.Errorf("expected %s counter to be unchanged, increased by %d", DisconnectClient, n)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := newConn()
+	defer c.Close()
+	ctx := context.Background()
+	if err := c.pubConn.Flush(ctx); err != nil {
+		t.Fatalf("could not flush empty conn: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.pubConn.Write([]byte("hello")); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := c.pubConn.Flush(timeoutCtx); err != context.DeadlineExceeded {
+		t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	flushed := make(chan error, 1)
+	go func() { flushed <- c.pubConn.Flush(ctx) }()
+	for i := 0; i < 2; i++ {
+		if _, err := c.next(); err != nil {
+			t.Fatalf("could not read buffered message: %v", err)
+		}
+	}
+	if err := <-flushed; err != nil {
+		t.Errorf("could not flush conn: %v", err)
+	}
+}
+
+func TestPollRequeue(t *testing.T) {
+	c := newConn()
+	defer c.Close()
+	for _, msg := range []string{"hello", "world"} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+	}
+	errDeliver := errors.New("client went away")
+	err := c.poll(context.Background(), func(b []byte) error { return errDeliver })
+	if err != errDeliver {
+		t.Fatalf("expected error %v, got %v", errDeliver, err)
+	}
+	if n := c.queued(); n != 1 {
+		t.Errorf("expected 1 queued payload, got %d", n)
+	}
+	if _, err := c.Write([]byte("!")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	var got []byte
+	if err := c.poll(context.Background(), func(b []byte) error {
+		got = b
+		return nil
+	}); err != nil {
+		t.Fatalf("could not poll: %v", err)
+	}
+	if expected := "helloworld!"; string(got) != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestPollRequeueUpgraded(t *testing.T) {
+	wss := make(chan *websocket.Conn, 1)
+	done := make(chan struct{})
+	defer close(done)
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		wss <- ws
+		<-done
+	}))
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	client, err := websocket.Dial("ws://"+serverAddr, "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer client.Close()
+	c := newConn()
+	defer c.Close()
+	if _, err := c.Write([]byte("6:4hello")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	// The upgrade runs while the poll is being answered, after buf has
+	// been taken by the poll, and the poll then fails.
+	errDeliver := errors.New("client went away")
+	err = c.poll(context.Background(), func(b []byte) error {
+		c.upgrade(<-wss)
+		return errDeliver
+	})
+	if err != errDeliver {
+		t.Fatalf("expected error %v, got %v", errDeliver, err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 64)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatalf("undelivered payload was not sent over the WebSocket: %v", err)
+	}
+	if expected := "4hello"; string(b[:n]) != expected {
+		t.Errorf("expected %q, got %q", expected, b[:n])
+	}
+}
+
+func TestPollCoalesce(t *testing.T) {
+	c := newConn()
+	defer c.Close()
+	c.coalesce = 50 * time.Millisecond
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Write([]byte("world"))
+	}()
+	var got []byte
+	if err := c.poll(context.Background(), func(b []byte) error {
+		got = b
+		return nil
+	}); err != nil {
+		t.Fatalf("could not poll: %v", err)
+	}
+	if expected := "helloworld"; string(got) != expected {
+		t.Errorf("expected writes within the delay to be sent together as %q, got %q", expected, got)
+	}
+}
+
+func BenchmarkPollCoalesce(b *testing.B) {
+	for _, delay := range []time.Duration{0, 10 * time.Millisecond} {
+		b.Run("delay="+delay.String(), func(b *testing.B) {
+			polls := 0
+			for i := 0; i < b.N; i++ {
+				c := newConn()
+				c.coalesce = delay
+				const numWrites = 100
+				go func() {
+					for j := 0; j < numWrites; j++ {
+						for {
+							if _, err := c.Write([]byte("hello")); err != ErrBackpressure {
+								break
+							}
+							time.Sleep(10 * time.Microsecond)
+						}
+						time.Sleep(20 * time.Microsecond)
+					}
+				}()
+				for n := 0; n < numWrites*len("hello"); {
+					c.poll(context.Background(), func(p []byte) error {
+						n += len(p)
+						return nil
+					})
+					polls++
+				}
+				c.Close()
+			}
+			b.ReportMetric(float64(polls)/float64(b.N), "polls/op")
+		})
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	client, server := NewPipeConn()
+	defer server.Close()
+	for _, msg := range []string{"hello", "Foo 世 bar"} {
+		if _, err := client.WriteString(msg); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+		if _, err := server.Read(make([]byte, 64)); err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("problem closing connection: %v", err)
+	}
+	out, in := client.Stats(), server.Stats()
+	if out.MessagesOut != 2 || out.BytesOut != 16 {
+		t.Errorf("expected 2 messages and 16 bytes out, got %+v", out)
+	}
+	if in.MessagesIn != 2 || in.BytesIn != 16 {
+		t.Errorf("expected 2 messages and 16 bytes in, got %+v", in)
+	}
+	if out.ConnectedAt.IsZero() || time.Since(out.ConnectedAt) > time.Minute {
+		t.Errorf("unexpected connect time %v", out.ConnectedAt)
+	}
+}
+
+func TestRTT(t *testing.T) {
+	c := newConn()
+	if rtt := c.pubConn.RTT(); rtt != 0 {
+		t.Errorf("expected no round-trip time before any ping, got %v", rtt)
+	}
+	for _, d := range []time.Duration{100, 200, 300} {
+		c.addRTT(d * time.Millisecond)
+	}
+	if rtt := c.pubConn.RTT(); rtt != 200*time.Millisecond {
+		t.Errorf("expected a mean of 200ms, got %v", rtt)
+	}
+	// Only the latest samples are kept.
+	for i := 0; i < rttSamples; i++ {
+		c.addRTT(10 * time.Millisecond)
+	}
+	if rtt := c.pubConn.RTT(); rtt != 10*time.Millisecond {
+		t.Errorf("expected older samples to be dropped, got %v", rtt)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	c := newConn()
+	defer c.Close()
+	msgs := [][]byte{[]byte("a"), []byte("bc"), []byte("世")}
+	if err := c.pubConn.WriteBatch(msgs); err != nil {
+		t.Fatalf("could not write batch: %v", err)
+	}
+	// The batch takes a single place in the send queue.
+	if n := len(c.buf); n != 1 {
+		t.Fatalf("expected one queued payload, got %d", n)
+	}
+	b, err := c.next()
+	if err != nil {
+		t.Fatalf("could not read buffered payload: %v", err)
+	}
+	var payload []packet
+	if err := newPayloadDecoder(bytes.NewReader(b)).decode(&payload); err != nil {
+		t.Fatalf("could not decode payload: %v", err)
+	}
+	if len(payload) != len(msgs) {
+		t.Fatalf("expected %d packets, got %d", len(msgs), len(payload))
+	}
+	for i, pkt := range payload {
+		if pkt.typ != packetTypeMessage || !bytes.Equal(pkt.data, msgs[i]) {
+			t.Errorf("expected message %q, got %+v", msgs[i], pkt)
+		}
+	}
+	if s := c.pubConn.Stats(); s.MessagesOut != 3 || s.BytesOut != 6 {
+		t.Errorf("expected 3 messages and 6 bytes out, got %+v", s)
+	}
+	c.maxMessageSize = 2
+	if err := c.pubConn.WriteBatch(msgs); err != ErrMessageTooLarge {
+		t.Errorf("expected error %v, got %v", ErrMessageTooLarge, err)
+	}
+	if n := len(c.buf); n != 0 {
+		t.Errorf("expected nothing to be queued, got %d payloads", n)
+	}
+}
+
+func TestPoke(t *testing.T) {
+	c := newConn()
+	defer c.Close()
+	done := make(chan []byte)
+	go func() {
+		b, err := c.next()
+		if err != nil {
+			t.Errorf("could not read buffered payload: %v", err)
+		}
+		done <- b
+	}()
+	c.pubConn.Poke()
+	select {
+	case b := <-done:
+		if string(b) != "1:6" {
+			t.Errorf("expected a noop payload, got %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the poll to return")
+	}
+	c.Close()
+	// Poking a closed connection does nothing, leaving only the
+	// close packet queued for the client.
+	queued := c.queued()
+	c.pubConn.Poke()
+	if n := c.queued(); n != queued {
+		t.Errorf("expected %d queued payloads, got %d", queued, n)
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	c := newConn()
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := c.pubConn.WriteString("out"); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+	}
+	if err := c.pubConn.WriteBatch([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("could not write batch: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.pubConn.onMessage([]byte("in"), false); err != nil {
+			t.Fatalf("could not deliver message: %v", err)
+		}
+	}
+	if send, recv := c.pubConn.QueueDepth(); send != 4 || recv != 2 {
+		t.Errorf("expected 4 queued payloads and 2 unread messages, got %d and %d", send, recv)
+	}
+	if _, err := c.next(); err != nil {
+		t.Fatalf("could not read buffered payload: %v", err)
+	}
+	if _, err := c.pubConn.ReadMessage(); err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if send, recv := c.pubConn.QueueDepth(); send != 3 || recv != 1 {
+		t.Errorf("expected 3 queued payloads and 1 unread message, got %d and %d", send, recv)
+	}
+}
+
+func TestCloseWithReasonDefaultMessage(t *testing.T) {
+	c := newConn()
+	if err := c.pubConn.CloseWithReason(errorBadRequest, ""); err != nil {
+		t.Fatalf("could not close connection: %v", err)
+	}
+	b, err := c.next()
+	if err != nil {
+		t.Fatalf("could not read close packet: %v", err)
+	}
+	var payload []packet
+	if err := newPayloadDecoder(bytes.NewReader(b)).decode(&payload); err != nil {
+		t.Fatalf("could not decode payload: %v", err)
+	}
+	expected := `{"code":3,"message":"Bad request"}`
+	if len(payload) != 1 || payload[0].typ != packetTypeClose || string(payload[0].data) != expected {
+		t.Errorf("expected a close packet with data %s, got %+v", expected, payload)
+	}
+	if !c.pubConn.Closed() {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	c := newConn()
+	pc := c.pubConn
+	pc.Pause()
+	for _, msg := range []string{"a", "b", "c"} {
+		if err := pc.onMessage([]byte(msg), false); err != nil {
+			t.Fatalf("could not deliver message: %v", err)
+		}
+	}
+	read := make(chan []byte, 3)
+	go func() {
+		for {
+			msg, err := pc.ReadMessage()
+			if err != nil {
+				close(read)
+				return
+			}
+			read <- msg
+		}
+	}()
+	select {
+	case msg := <-read:
+		t.Fatalf("expected no message while paused, got %q", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+	pc.Resume()
+	for _, expected := range []string{"a", "b", "c"} {
+		if msg := <-read; string(msg) != expected {
+			t.Errorf("expected %q, got %q", expected, msg)
+		}
+	}
+	// Closing a paused connection releases its reader.
+	pc.Pause()
+	c.Close()
+	select {
+	case _, ok := <-read:
+		if ok {
+			t.Error("expected no more messages")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the reader to be released by close")
+	}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	c := newConn()
+	pc := c.pubConn
+	for i := 0; i < 2; i++ {
+		if _, err := pc.Write([]byte("hello")); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		// Writes are refused while the queue drains.
+		if _, err := c.pubConn.Write([]byte("late")); err != errClosing {
+			errc <- fmt.Errorf("expected error %v, got %v", errClosing, err)
+			return
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := c.next(); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	if err := pc.CloseGracefully(context.Background()); err != nil {
+		t.Fatalf("could not close connection: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	// The close packet follows the messages.
+	if b, err := c.next(); err != nil || string(b) != "1:1" {
+		t.Errorf("expected a close packet, got %q (%v)", b, err)
+	}
+
+	// The connection is closed at once if the context expires.
+	c = newConn()
+	if _, err := c.pubConn.Write([]byte("hello")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.pubConn.CloseGracefully(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if !c.isClosed() {
+		t.Error("expected the connection to be closed")
+	}
 }
@@ -8,10 +8,14 @@ package ftc
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"strconv"
+	"sync"
+	"unicode/utf8"
 
 	"code.google.com/p/go.net/websocket"
 )
@@ -46,46 +50,151 @@ func init() {
 type packet struct {
 	typ  byte
 	data []byte
+	// Whether the packet holds binary data. In a binary WebSocket frame
+	// the data is the whole frame, with no type byte; elsewhere it is
+	// sent as text, prefixed with binaryPrefix and base64-encoded.
+	binary bool
 }
 
+// binaryPrefix marks a text-encoded packet whose data is binary and
+// base64-encoded, for transports and clients that cannot carry binary.
+const binaryPrefix = 'b'
+
+// A frame is a WebSocket frame received by frameCodec.
+type frame struct {
+	data   []byte
+	binary bool
+}
+
+// frameCodec receives a WebSocket frame into a *frame, recording
+// whether it was binary, which websocket.Message does not report.
+var frameCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*frame)
+		f.data = data
+		f.binary = payloadType == websocket.BinaryFrame
+		return nil
+	},
+}
+
+// defaultMaxPacketSize is the default limit, in bytes, on the size
+// of a single encoded packet accepted by a packetDecoder.
+const defaultMaxPacketSize = 1 << 20
+
+var errPacketTooLarge = errors.New("packet exceeds maximum size")
+
+// errEmptyPacket is returned when a packet is missing its type byte.
+var errEmptyPacket = errors.New("packet is missing its type")
+
 // A packetDecoder reads and decodes FTC Packets from an input stream.
 type packetDecoder struct {
-	r io.Reader
+	r       io.Reader
+	maxSize int64 // The largest encoded packet that will be accepted.
+	// Whether the peer may batch several packets into a WebSocket
+	// frame, which must be negotiated, since a frame holding a single
+	// packet may also look like a payload.
+	batched bool
+	pending []packet // Packets from a batched frame yet to be returned.
 }
 
 // newPacketDecoder allocates and returns a new decoder that reads from r.
 func newPacketDecoder(r io.Reader) *packetDecoder {
-	return &packetDecoder{r: r}
+	return &packetDecoder{r: r, maxSize: defaultMaxPacketSize}
 }
 
 // decode reads the next encoded packet from its input
 // and stores it in the value pointed to by pkt.
+//
+// A WebSocket input is read one frame at a time. A frame holds exactly
+// one packet, unless the decoder is batched, in which case a text frame
+// may hold several packets using the payload encoding; these are
+// returned by successive calls. A binary frame is returned as a message
+// holding the whole frame. Any other input is read until EOF.
 func (dec *packetDecoder) decode(pkt *packet) error {
-	var r io.Reader
 	if ws, _ := dec.r.(*websocket.Conn); ws != nil {
-		var data []byte
-		if err := websocket.Message.Receive(ws, &data); err != nil {
+		if len(dec.pending) > 0 {
+			*pkt = dec.pending[0]
+			dec.pending = dec.pending[1:]
+			return nil
+		}
+		// The websocket package has no way to bound the size of a
+		// frame before it is read, so the limit is checked after.
+		var f frame
+		if err := frameCodec.Receive(ws, &f); err != nil {
 			return err
 		}
-		r = bytes.NewReader(data)
-	} else {
-		r = dec.r
-	}
-	// Get the packet type.
-	var pktType [1]byte
-	if _, err := io.ReadFull(r, pktType[:]); err != nil {
-		return err
-	}
-	if _, valid := packetTypeLookup[pktType[0]]; !valid {
-		return fmt.Errorf("invalid packet type %q", pktType)
+		data := f.data
+		if f.binary {
+			if int64(len(data)) > dec.maxSize {
+				return errPacketTooLarge
+			}
+			*pkt = packet{typ: packetTypeMessage, data: data, binary: true}
+			return nil
+		}
+		if !dec.batched {
+			return dec.parse(data, pkt)
+		}
+		if batch := dec.parseBatch(data); len(batch) > 1 {
+			*pkt = batch[0]
+			dec.pending = batch[1:]
+			return nil
+		}
+		return dec.parse(data, pkt)
 	}
-	pkt.typ = pktType[0]
-	// Read the rest of the packet.
-	b, err := ioutil.ReadAll(r)
+	data, err := ioutil.ReadAll(io.LimitReader(dec.r, dec.maxSize+1))
 	if err != nil {
 		return fmt.Errorf("unable to read: %v", err)
 	}
-	pkt.data = b
+	return dec.parse(data, pkt)
+}
+
+// parseBatch returns the packets in data if it is a payload-encoded
+// batch, or nil otherwise. Only a payload of two or more packets is
+// treated as a batch, so that a single packet whose data happens to
+// look like a payload of one packet is not misread; one that looks
+// like several still is, which is why batching must be negotiated.
+func (dec *packetDecoder) parseBatch(data []byte) []packet {
+	if int64(len(data)) > dec.maxSize || bytes.IndexByte(data, ':') < 0 {
+		return nil
+	}
+	var pkts []packet
+	payloadDec := newPayloadDecoder(bytes.NewReader(data))
+	payloadDec.maxSize = dec.maxSize
+	if err := payloadDec.decode(&pkts); err != nil {
+		return nil
+	}
+	return pkts
+}
+
+// parse stores the packet encoded in data in the value pointed to by pkt.
+// The first byte is the packet type and the remainder, which may be
+// empty, is the packet data. A packet that starts with binaryPrefix
+// has its type next and base64-encoded binary data.
+func (dec *packetDecoder) parse(data []byte, pkt *packet) error {
+	if int64(len(data)) > dec.maxSize {
+		return errPacketTooLarge
+	}
+	binary := len(data) > 0 && data[0] == binaryPrefix
+	if binary {
+		data = data[1:]
+	}
+	if len(data) == 0 {
+		return errEmptyPacket
+	}
+	if _, valid := packetTypeLookup[data[0]]; !valid {
+		return fmt.Errorf("invalid packet type %q", data[0])
+	}
+	pkt.typ = data[0]
+	pkt.data = data[1:]
+	pkt.binary = binary
+	if binary {
+		b := make([]byte, base64.StdEncoding.DecodedLen(len(pkt.data)))
+		n, err := base64.StdEncoding.Decode(b, pkt.data)
+		if err != nil {
+			return fmt.Errorf("invalid binary packet: %v", err)
+		}
+		pkt.data = b[:n]
+	}
 	return nil
 }
 
@@ -98,6 +207,7 @@ type writer interface {
 // A packetEncoder writes FTC Packets to an output stream.
 type packetEncoder struct {
 	w   writer
+	buf []byte // Scratch space holding the packet being written.
 	err error
 }
 
@@ -115,13 +225,6 @@ func (e *packetEncoder) flush() {
 	e.err = e.w.Flush()
 }
 
-func (e *packetEncoder) writeByte(p byte) {
-	if e.err != nil {
-		return
-	}
-	e.err = e.w.WriteByte(p)
-}
-
 // newPacketEncoder allocates and returns a new encoder that writes to w.
 func newPacketEncoder(w io.Writer) *packetEncoder {
 	e := &packetEncoder{}
@@ -133,17 +236,31 @@ func newPacketEncoder(w io.Writer) *packetEncoder {
 	return e
 }
 
-// encode writes the encoded packet to the stream.
+// encode writes the encoded packet to the stream. The packet is
+// written with a single call so that message-oriented writers,
+// such as a WebSocket, receive it as one message. A binary packet
+// is written as text, with its data base64-encoded.
 func (e *packetEncoder) encode(p packet) error {
-	// Write the type info.
-	e.writeByte(p.typ)
-	if p.data != nil {
-		e.write(p.data)
+	if p.binary {
+		e.buf = append(e.buf[:0], binaryPrefix, p.typ)
+		n := len(e.buf)
+		e.buf = append(e.buf, make([]byte, base64.StdEncoding.EncodedLen(len(p.data)))...)
+		base64.StdEncoding.Encode(e.buf[n:], p.data)
+	} else {
+		e.buf = append(e.buf[:0], p.typ)
+		e.buf = append(e.buf, p.data...)
 	}
+	e.write(e.buf)
 	e.flush()
 	return e.err
 }
 
+// reset clears any error recorded by a previous encode so
+// that the encoder can be reused.
+func (e *packetEncoder) reset() {
+	e.err = nil
+}
+
 // A payloadEncoder writes FTC Payloads to an output stream.
 type payloadEncoder struct {
 	w   writer
@@ -182,22 +299,43 @@ func newPayloadEncoder(w io.Writer) *payloadEncoder {
 	return e
 }
 
+// A payloadBuffer holds the scratch space used to size each
+// packet of a payload before it is written.
+type payloadBuffer struct {
+	bytes.Buffer
+	enc    *packetEncoder
+	prefix []byte
+}
+
+// payloadBuffers reduces per-payload allocations. Encoded bytes are
+// always copied to the destination writer before a payloadBuffer is
+// returned to the pool, so reuse is safe.
+var payloadBuffers = sync.Pool{
+	New: func() interface{} {
+		b := &payloadBuffer{}
+		b.enc = newPacketEncoder(&b.Buffer)
+		return b
+	},
+}
+
 // encode writes the encoded packets as a payload to the stream.
 func (e *payloadEncoder) encode(p []packet) error {
 	// The bytes cannot be written directly to the underlying
 	// writer because the size of each payload is required as
 	// a prefix.
-	var buf bytes.Buffer
-	pEnc := newPacketEncoder(&buf)
+	buf := payloadBuffers.Get().(*payloadBuffer)
+	defer payloadBuffers.Put(buf)
 	for _, pkt := range p {
-		if err := pEnc.encode(pkt); err != nil {
+		buf.Reset()
+		buf.enc.reset()
+		if err := buf.enc.encode(pkt); err != nil {
 			return err
 		}
 
-		e.write([]byte(strconv.Itoa(buf.Len())))
+		buf.prefix = strconv.AppendInt(buf.prefix[:0], int64(utf16Len(buf.Bytes())), 10)
+		e.write(buf.prefix)
 		e.writeByte(':')
 		e.write(buf.Bytes())
-		buf.Reset()
 	}
 	e.flush()
 	return e.err
@@ -205,12 +343,69 @@ func (e *payloadEncoder) encode(p []packet) error {
 
 // A payloadDecoder reads and decodes FTC Payloads from an input stream.
 type payloadDecoder struct {
-	r io.Reader
+	r       io.Reader
+	maxSize int64 // The largest encoded packet that will be accepted.
 }
 
 // newPayloadDecoder allocates and returns a new decoder that reads from r.
 func newPayloadDecoder(r io.Reader) *payloadDecoder {
-	return &payloadDecoder{r: r}
+	return &payloadDecoder{r: r, maxSize: defaultMaxPacketSize}
+}
+
+// parseLength parses the length prefix of a packet within a payload,
+// which must be a non-empty string of decimal digits.
+func parseLength(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, fmt.Errorf("missing packet length")
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid packet length %q", b)
+		}
+	}
+	size, err := strconv.Atoi(string(b))
+	if err != nil {
+		return 0, fmt.Errorf("invalid packet length %q", b)
+	}
+	return size, nil
+}
+
+// utf16Len returns the length of b in UTF-16 code units, which is how
+// JavaScript clients measure the packets within a payload. Bytes that
+// are not valid UTF-8 count as one unit each.
+func utf16Len(b []byte) int {
+	n := 0
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r > 0xffff {
+			n += 2
+		} else {
+			n++
+		}
+		b = b[size:]
+	}
+	return n
+}
+
+// utf16Offset returns the number of bytes at the start of b that
+// make up n UTF-16 code units. ok is false if b is too short to hold
+// them, and err is non-nil if n ends within a surrogate pair.
+func utf16Offset(b []byte, n int, atEOF bool) (offset int, ok bool, err error) {
+	for n > 0 {
+		if len(b[offset:]) == 0 || !atEOF && !utf8.FullRune(b[offset:]) {
+			return 0, false, nil
+		}
+		r, size := utf8.DecodeRune(b[offset:])
+		if r > 0xffff {
+			if n == 1 {
+				return 0, false, errors.New("packet length splits a surrogate pair")
+			}
+			n--
+		}
+		n--
+		offset += size
+	}
+	return offset, true, nil
 }
 
 // scanPacket is used as the split function by the Scanner within Decode.
@@ -219,13 +414,29 @@ func scanPacket(data []byte, atEOF bool) (int, []byte, error) {
 		return 0, nil, nil
 	}
 	if i := bytes.IndexByte(data, ':'); i >= 0 {
-		size, err := strconv.Atoi(string(data[0:i]))
+		// The length is counted in UTF-16 code units.
+		length, err := parseLength(data[0:i])
+		if err != nil {
+			return 0, nil, err
+		}
+		size, ok, err := utf16Offset(data[i+1:], length, atEOF)
 		if err != nil {
 			return 0, nil, err
 		}
+		if !ok {
+			if atEOF {
+				return 0, nil, io.ErrUnexpectedEOF
+			}
+			// Request the rest of the packet.
+			return 0, nil, nil
+		}
 		// Add 1 to account for delimiter.
 		return i + 1 + size, data[i+1 : i+1+size], nil
 	}
+	if atEOF {
+		// The input ended partway through a length prefix.
+		return 0, nil, io.ErrUnexpectedEOF
+	}
 	// Request more data.
 	return 0, nil, nil
 }
@@ -237,11 +448,14 @@ func scanPacket(data []byte, atEOF bool) (int, []byte, error) {
 func (dec *payloadDecoder) decode(pkts *[]packet) error {
 	scanner := bufio.NewScanner(dec.r)
 	scanner.Split(scanPacket)
+	// Leave room for the length prefix and delimiter.
+	scanner.Buffer(nil, int(dec.maxSize)+len(strconv.FormatInt(dec.maxSize, 10))+1)
 	*pkts = []packet{}
 	for i := 0; scanner.Scan(); i++ {
 		var pkt packet
-		r := bytes.NewReader(scanner.Bytes())
-		if err := newPacketDecoder(r).decode(&pkt); err != nil {
+		pktDec := newPacketDecoder(bytes.NewReader(scanner.Bytes()))
+		pktDec.maxSize = dec.maxSize
+		if err := pktDec.decode(&pkt); err != nil {
 			return err
 		}
 		*pkts = append(*pkts, pkt)
@@ -71,6 +71,56 @@ func TestPacketEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestEmptyPacketData(t *testing.T) {
+	for typ := range packetTypeLookup {
+		var buf bytes.Buffer
+		if err := newPayloadEncoder(&buf).encode([]packet{packet{typ: typ}}); err != nil {
+			t.Fatalf("could not encode packet of type %q: %v", typ, err)
+		}
+		expected := "1:" + string(typ)
+		if buf.String() != expected {
+			t.Errorf("output mismatch. expected %q, got %q", expected, buf.String())
+		}
+		var pkts []packet
+		if err := newPayloadDecoder(&buf).decode(&pkts); err != nil {
+			t.Fatalf("could not decode packet of type %q: %v", typ, err)
+		}
+		if len(pkts) != 1 || pkts[0].typ != typ || len(pkts[0].data) != 0 {
+			t.Errorf("expected a single packet of type %q with no data, got %+v", typ, pkts)
+		}
+	}
+	var pkt packet
+	if err := newPacketDecoder(strings.NewReader("")).decode(&pkt); err != errEmptyPacket {
+		t.Errorf("expected error %v, got %v", errEmptyPacket, err)
+	}
+	var pkts []packet
+	if err := newPayloadDecoder(strings.NewReader("0:")).decode(&pkts); err != errEmptyPacket {
+		t.Errorf("expected error %v, got %v", errEmptyPacket, err)
+	}
+}
+
+func TestBinaryPacket(t *testing.T) {
+	pkt := packet{typ: packetTypeMessage, data: []byte{0, 1, 2, 0xff}, binary: true}
+	var buf bytes.Buffer
+	if err := newPayloadEncoder(&buf).encode([]packet{pkt}); err != nil {
+		t.Fatalf("could not encode packet %+v: %v", pkt, err)
+	}
+	if expected := "10:b4AAEC/w=="; buf.String() != expected {
+		t.Errorf("output mismatch. expected %q, got %q", expected, buf.String())
+	}
+	var pkts []packet
+	if err := newPayloadDecoder(&buf).decode(&pkts); err != nil {
+		t.Fatalf("could not decode payload: %v", err)
+	}
+	if len(pkts) != 1 || pkts[0].typ != pkt.typ || !pkts[0].binary || !bytes.Equal(pkts[0].data, pkt.data) {
+		t.Errorf("expected %+v, got %+v", pkt, pkts)
+	}
+	var newPkt packet
+	if err := newPacketDecoder(strings.NewReader("b4!")).decode(&newPkt); err == nil {
+		t.Error("expected an error decoding invalid base64")
+	}
+}
+
 func TestPayloadEncodeDecode(t *testing.T) {
 	p := []packet{
 		packet{typ: packetTypeOpen, data: []byte("{\"Val\":\"Foo 世 bar baz 界 qux\"}\n")},
@@ -98,6 +148,39 @@ func TestPayloadEncodeDecode(t *testing.T) {
 	log.Println(buf.String())
 }
 
+func TestPayloadUTF16Length(t *testing.T) {
+	p := []packet{
+		packet{typ: packetTypeMessage, data: []byte("世界")},
+		packet{typ: packetTypeMessage, data: []byte("hi 😀")},
+		packet{typ: packetTypePing, data: []byte("probe")},
+	}
+	var buf bytes.Buffer
+	if err := newPayloadEncoder(&buf).encode(p); err != nil {
+		t.Fatalf("could not encode payload: %v", err)
+	}
+	// Lengths are counted in UTF-16 code units, as a JavaScript client
+	// does: the emoji lies outside the BMP and counts as two.
+	if expected := "3:4世界6:4hi 😀6:2probe"; buf.String() != expected {
+		t.Errorf("output mismatch. expected %q, got %q", expected, buf.String())
+	}
+	var pkts []packet
+	if err := newPayloadDecoder(&buf).decode(&pkts); err != nil {
+		t.Fatalf("could not decode payload: %v", err)
+	}
+	if len(pkts) != len(p) {
+		t.Fatalf("expected %d packets, got %d", len(p), len(pkts))
+	}
+	for i, pkt := range p {
+		if pkt.typ != pkts[i].typ || !bytes.Equal(pkt.data, pkts[i].data) {
+			t.Errorf("expected packet %q, got %q", pkt.data, pkts[i].data)
+		}
+	}
+	// A length that ends within a surrogate pair is malformed.
+	if err := newPayloadDecoder(strings.NewReader("2:4😀")).decode(&pkts); err == nil {
+		t.Error("expected error decoding a length that splits a surrogate pair")
+	}
+}
+
 func BenchmarkPacketEncode(b *testing.B) {
 	b.StopTimer()
 	enc := newPacketEncoder(ioutil.Discard)
@@ -117,3 +200,78 @@ func BenchmarkPacketDecode(b *testing.B) {
 		dec.decode(&p)
 	}
 }
+
+func BenchmarkPayloadEncode(b *testing.B) {
+	b.ReportAllocs()
+	enc := newPayloadEncoder(ioutil.Discard)
+	p := []packet{
+		packet{typ: packetTypeMessage, data: []byte("Foo 世 bar baz 界 qux")},
+		packet{typ: packetTypePing, data: []byte("probe")},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		enc.encode(p)
+	}
+}
+
+func TestPacketTooLarge(t *testing.T) {
+	dec := newPacketDecoder(strings.NewReader("4" + strings.Repeat("a", 10)))
+	dec.maxSize = 10
+	var pkt packet
+	if err := dec.decode(&pkt); err != errPacketTooLarge {
+		t.Errorf("expected error %v, got %v", errPacketTooLarge, err)
+	}
+	dec = newPacketDecoder(strings.NewReader("4" + strings.Repeat("a", 9)))
+	dec.maxSize = 10
+	if err := dec.decode(&pkt); err != nil {
+		t.Errorf("could not decode packet within the size limit: %v", err)
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	testCases := map[string]int{
+		"6:2probe1:5": 2,
+		"4:4hey":      1, // A message whose data is ":4hey".
+		"4hello":      0,
+		"2probe":      0,
+		"9:2probe":    0,
+	}
+	dec := newPacketDecoder(nil)
+	for data, expected := range testCases {
+		if n := len(dec.parseBatch([]byte(data))); n != expected {
+			t.Errorf("%q: expected %d packets, got %d", data, expected, n)
+		}
+	}
+}
+
+func TestPayloadDecodeMalformed(t *testing.T) {
+	testCases := []string{
+		"-1:",
+		"-5:4hello",
+		"+5:4hello",
+		":4hello",
+		"1a:4",
+		"7:4hello",
+		"100:4hello",
+		"99999999999999999999:4",
+		"6:4hello5",
+	}
+	for _, data := range testCases {
+		var pkts []packet
+		if err := newPayloadDecoder(strings.NewReader(data)).decode(&pkts); err == nil {
+			t.Errorf("%q: expected error decoding payload, got %+v", data, pkts)
+		}
+	}
+}
+
+func FuzzPayloadDecode(f *testing.F) {
+	for _, seed := range []string{"6:4hello", "1:6", "6:2probe1:5", "-1:", "100:4hello"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data string) {
+		var pkts []packet
+		dec := newPayloadDecoder(strings.NewReader(data))
+		dec.maxSize = 1 << 10
+		dec.decode(&pkts)
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// socketIOEvent is the socket.io packet type of an event. An event is
+// sent as a message holding the type followed by a JSON array of the
+// event’s name and arguments, such as 2["chat","hi"].
+const socketIOEvent byte = '2'
+
+var errEventName = errors.New("event name must not be empty")
+
+// Emit sends the named event with the given arguments to the client,
+// encoded as a socket.io event in a single message. Each argument is
+// encoded as JSON.
+func (c *Conn) Emit(event string, args ...interface{}) error {
+	if len(event) == 0 {
+		return errEventName
+	}
+	b, err := json.Marshal(append([]interface{}{event}, args...))
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(append([]byte{socketIOEvent}, b...))
+	return err
+}
+
+// On registers handler to be called with the JSON-encoded arguments of
+// each socket.io event with the given name that the client sends,
+// replacing any handler already registered for it. Events with a
+// handler are not returned by Read. Messages that are not events, and
+// events with no handler, are read as usual. A nil handler removes the
+// registration. Acknowledgements and namespaces are not supported, so
+// events sent to a namespace other than the default are read as usual.
+//
+// Handlers are called one at a time, in the order the events arrive,
+// on the goroutine that receives the connection’s packets, so a
+// handler that blocks holds up everything the client sends after the
+// event; long-running work should be passed to another goroutine.
+// While the connection is paused, events wait for Resume as messages
+// do. See Pause.
+func (c *Conn) On(event string, handler func(args []json.RawMessage)) {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	if handler == nil {
+		delete(c.events, event)
+		return
+	}
+	if c.events == nil {
+		c.events = map[string]func([]json.RawMessage){}
+	}
+	c.events[event] = handler
+}
+
+// eventHandler returns the handler registered for the event in msg,
+// and the event’s arguments, or a nil handler if msg is not an event
+// or has no handler.
+func (c *Conn) eventHandler(msg []byte) (handler func([]json.RawMessage), args []json.RawMessage) {
+	c.eventsMu.RLock()
+	defer c.eventsMu.RUnlock()
+	if len(c.events) == 0 {
+		return nil, nil
+	}
+	name, args, ok := parseEvent(msg)
+	if !ok {
+		return nil, nil
+	}
+	return c.events[name], args
+}
+
+// parseEvent returns the name and arguments of the socket.io event in
+// msg. ok is false if msg is not an event in the default namespace. An
+// acknowledgement ID, which may follow the packet type, is ignored.
+func parseEvent(msg []byte) (name string, args []json.RawMessage, ok bool) {
+	if len(msg) == 0 || msg[0] != socketIOEvent {
+		return "", nil, false
+	}
+	i := 1
+	for i < len(msg) && msg[i] >= '0' && msg[i] <= '9' {
+		i++
+	}
+	if i == len(msg) || msg[i] != '[' {
+		return "", nil, false
+	}
+	var arr []json.RawMessage
+	if err := json.Unmarshal(msg[i:], &arr); err != nil || len(arr) == 0 {
+		return "", nil, false
+	}
+	if err := json.Unmarshal(arr[0], &name); err != nil || len(name) == 0 {
+		return "", nil, false
+	}
+	return name, arr[1:], true
+}
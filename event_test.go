@@ -0,0 +1,118 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEmit(t *testing.T) {
+	client, server := NewPipeConn()
+	defer client.Close()
+	if err := server.Emit("chat", "hi", 3, map[string]bool{"ok": true}); err != nil {
+		t.Fatalf("could not emit event: %v", err)
+	}
+	msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if expected := `2["chat","hi",3,{"ok":true}]`; string(msg) != expected {
+		t.Errorf("expected %q, got %q", expected, msg)
+	}
+	if err := server.Emit(""); err != errEventName {
+		t.Errorf("expected error %v, got %v", errEventName, err)
+	}
+}
+
+func TestOn(t *testing.T) {
+	client, server := NewPipeConn()
+	defer client.Close()
+	events := make(chan []json.RawMessage, 1)
+	server.On("chat", func(args []json.RawMessage) { events <- args })
+	if err := client.Emit("chat", "hi", 3); err != nil {
+		t.Fatalf("could not emit event: %v", err)
+	}
+	select {
+	case args := <-events:
+		var s string
+		var n int
+		if len(args) != 2 || json.Unmarshal(args[0], &s) != nil || json.Unmarshal(args[1], &n) != nil || s != "hi" || n != 3 {
+			t.Errorf("expected arguments \"hi\" and 3, got %q", args)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	// Other messages, and events with no handler, are read as usual.
+	for _, msg := range []string{"hello", `2["other"]`} {
+		if _, err := client.WriteString(msg); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+		b, err := server.ReadMessage()
+		if err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+		if string(b) != msg {
+			t.Errorf("expected %q, got %q", msg, b)
+		}
+	}
+	server.On("chat", nil)
+	if err := client.Emit("chat"); err != nil {
+		t.Fatalf("could not emit event: %v", err)
+	}
+	if b, err := server.ReadMessage(); err != nil || string(b) != `2["chat"]` {
+		t.Errorf("expected the event to be read once its handler was removed, got %q, %v", b, err)
+	}
+}
+
+func TestOnPaused(t *testing.T) {
+	client, server := NewPipeConn()
+	defer client.Close()
+	events := make(chan string, 1)
+	server.On("chat", func(args []json.RawMessage) { events <- "chat" })
+	server.Pause()
+	if err := client.Emit("chat"); err != nil {
+		t.Fatalf("could not emit event: %v", err)
+	}
+	select {
+	case <-events:
+		t.Fatal("expected the event to wait while the connection is paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	server.Resume()
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("expected the event to be dispatched once resumed")
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		name string
+		args int
+		ok   bool
+	}{
+		{`2["chat","hi"]`, "chat", 1, true},
+		{`2["chat"]`, "chat", 0, true},
+		{`212["chat",1,2]`, "chat", 2, true},
+		{`2/admin,["chat"]`, "", 0, false},
+		{`2[]`, "", 0, false},
+		{`2[""]`, "", 0, false},
+		{`2[1]`, "", 0, false},
+		{`2["chat"`, "", 0, false},
+		{`3["chat"]`, "", 0, false},
+		{`2`, "", 0, false},
+		{``, "", 0, false},
+	} {
+		name, args, ok := parseEvent([]byte(tc.msg))
+		if ok != tc.ok || name != tc.name || len(args) != tc.args {
+			t.Errorf("%q: expected %q with %d args (%v), got %q with %d args (%v)", tc.msg, tc.name, tc.args, tc.ok, name, len(args), ok)
+		}
+	}
+}
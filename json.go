@@ -0,0 +1,39 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import "encoding/json"
+
+// A JSONConn sends and receives JSON-encoded values over a Conn.
+// Each value is carried in a single message.
+type JSONConn struct {
+	c *Conn
+}
+
+// NewJSONConn returns a JSONConn that exchanges values over c.
+func NewJSONConn(c *Conn) *JSONConn {
+	return &JSONConn{c: c}
+}
+
+// Send writes the JSON encoding of v to the connection as one message.
+func (j *JSONConn) Send(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = j.c.Write(b)
+	return err
+}
+
+// Recv reads the next message from the connection and stores its
+// JSON-decoded value in v.
+func (j *JSONConn) Recv(v interface{}) error {
+	msg, err := j.c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg, v)
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+type jsonTestValue struct {
+	Name  string
+	Count int
+	Tags  []string
+}
+
+func TestJSONConn(t *testing.T) {
+	client, server := NewPipeConn()
+	jc, js := NewJSONConn(client), NewJSONConn(server)
+	sent := jsonTestValue{Name: "Foo 世 bar baz 界 qux", Count: 3, Tags: []string{"a", "b"}}
+	if err := jc.Send(sent); err != nil {
+		t.Fatalf("could not send value: %v", err)
+	}
+	var received jsonTestValue
+	if err := js.Recv(&received); err != nil {
+		t.Fatalf("could not receive value: %v", err)
+	}
+	if !reflect.DeepEqual(sent, received) {
+		t.Errorf("expected to receive %+v, got %+v", sent, received)
+	}
+	if _, err := client.Write([]byte("not json")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	if err := js.Recv(&received); err == nil {
+		t.Error("expected error receiving invalid JSON")
+	}
+	client.Close()
+	if err := js.Recv(&received); err != io.EOF {
+		t.Errorf("expected io.EOF after close, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// A Logger receives the log output of a server and its connections.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// glogLogger is the default Logger, which writes to glog.
+type glogLogger struct{}
+
+func (glogLogger) Infof(format string, args ...interface{})    { glog.Infof(format, args...) }
+func (glogLogger) Warningf(format string, args ...interface{}) { glog.Warningf(format, args...) }
+func (glogLogger) Errorf(format string, args ...interface{})   { glog.Errorf(format, args...) }
+
+// WithLogFields attaches the given fields to every line logged
+// about the connection, alongside its session ID. Fields are
+// merged with any that were set previously.
+func (c *Conn) WithLogFields(fields map[string]interface{}) {
+	c.c.mu.Lock()
+	defer c.c.mu.Unlock()
+	if c.c.fields == nil {
+		c.c.fields = map[string]interface{}{}
+	}
+	for k, v := range fields {
+		c.c.fields[k] = v
+	}
+}
+
+// logFields returns the connection’s session ID and log fields
+// formatted as space-separated key=value pairs, sorted by key.
+func (c *conn) logFields() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	keys := make([]string, 0, len(c.fields))
+	for k := range c.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "sid=%s", c.id)
+	for _, k := range keys {
+		fmt.Fprintf(&buf, " %s=%v", k, c.fields[k])
+	}
+	return buf.String()
+}
+
+func (c *conn) infof(format string, args ...interface{}) {
+	c.logger.Infof("%s %s", fmt.Sprintf(format, args...), c.logFields())
+}
+
+func (c *conn) warningf(format string, args ...interface{}) {
+	c.logger.Warningf("%s %s", fmt.Sprintf(format, args...), c.logFields())
+}
+
+func (c *conn) errorf(format string, args ...interface{}) {
+	c.logger.Errorf("%s %s", fmt.Sprintf(format, args...), c.logFields())
+}
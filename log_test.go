@@ -0,0 +1,76 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLogger records every line logged through it.
+type testLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) log(format string, args ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+	l.Unlock()
+}
+
+func (l *testLogger) Infof(format string, args ...interface{})    { l.log(format, args...) }
+func (l *testLogger) Warningf(format string, args ...interface{}) { l.log(format, args...) }
+func (l *testLogger) Errorf(format string, args ...interface{})   { l.log(format, args...) }
+
+func (l *testLogger) contains(substrs ...string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, line := range l.lines {
+		found := true
+		for _, s := range substrs {
+			if !strings.Contains(line, s) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConnLogFields(t *testing.T) {
+	logger := &testLogger{}
+	ready := make(chan struct{})
+	ftcServer := NewServer(&Options{Logger: logger}, func(c *Conn) {
+		c.WithLogFields(map[string]interface{}{"user": "alice"})
+		close(ready)
+		<-c.Done()
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	<-ready
+	var buf bytes.Buffer
+	if err := newPayloadEncoder(&buf).encode([]packet{packet{typ: packetTypePing}}); err != nil {
+		t.Fatalf("could not encode payload: %v", err)
+	}
+	resp, err := http.Post(ts.URL+defaultBasePath+"?transport=polling&sid="+sid, "text/plain;charset=UTF-8", &buf)
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	resp.Body.Close()
+	if !logger.contains("handling packet type", "sid="+sid, "user=alice") {
+		t.Errorf("expected a log line with the conn’s fields, got %q", logger.lines)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+)
+
+// NewPipeConn returns two Conns connected in memory, without a server
+// or network in between. Messages written to one can be read from the
+// other, and closing either closes both. It is intended for tests.
+func NewPipeConn() (client *Conn, server *Conn) {
+	c, s := newConn(), newConn()
+	s.id = c.id
+	go pipe(c, s)
+	go pipe(s, c)
+	return c.pubConn, s.pubConn
+}
+
+// pipe delivers the packets written to src to dst until src is closed,
+// at which point dst is closed too.
+func pipe(src, dst *conn) {
+	defer dst.close(DisconnectClient, nil)
+	for {
+		b, err := src.next()
+		if err != nil {
+			return
+		}
+		var payload []packet
+		if err := newPayloadDecoder(bytes.NewReader(b)).decode(&payload); err != nil {
+			src.errorf("could not decode payload: %v", err)
+			continue
+		}
+		for _, pkt := range payload {
+			switch pkt.typ {
+			case packetTypeMessage:
+				dst.pubConn.onMessage(pkt.data, pkt.binary)
+			case packetTypeClose:
+				return
+			}
+		}
+	}
+}
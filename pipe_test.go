@@ -0,0 +1,75 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestPipeConn(t *testing.T) {
+	client, server := NewPipeConn()
+	for _, tc := range []struct {
+		from, to *Conn
+		msg      []byte
+	}{
+		{client, server, []byte("hello")},
+		{server, client, []byte("Foo 世 bar baz 界 qux")},
+	} {
+		if _, err := tc.from.Write(tc.msg); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+		b := make([]byte, 64)
+		n, err := tc.to.Read(b)
+		if err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+		if !bytes.Equal(b[:n], tc.msg) {
+			t.Errorf("expected %q, got %q", tc.msg, b[:n])
+		}
+	}
+	if _, err := server.WriteString("hi 😀"); err != nil {
+		t.Fatalf("could not write string: %v", err)
+	}
+	b := make([]byte, 64)
+	n, err := client.Read(b)
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if string(b[:n]) != "hi 😀" {
+		t.Errorf("expected %q, got %q", "hi 😀", b[:n])
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("problem closing connection: %v", err)
+	}
+	if _, err := server.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("expected io.EOF once the other end closed, got %v", err)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	client, server := NewPipeConn()
+	defer client.Close()
+	msg := bytes.Repeat([]byte("Foo 世 bar baz 界 qux"), 1000)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write(msg); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+	}
+	// Read truncates the message to fit p.
+	b := make([]byte, 64)
+	if n, err := server.Read(b); err != nil || n != len(b) {
+		t.Fatalf("expected a full read of %d bytes, got %d, %v", len(b), n, err)
+	}
+	got, err := server.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("expected a message of %d bytes, got %d", len(msg), len(got))
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"sync"
+	"time"
+)
+
+// A RateLimit describes a token bucket: events are allowed at Rate
+// per second on average, with bursts of up to Burst events.
+type RateLimit struct {
+	Rate  float64 // Tokens added to the bucket per second.
+	Burst int     // The size of the bucket. If less than 1, 1 is used.
+}
+
+// A bucket holds the tokens available to one key of a rateLimiter.
+type bucket struct {
+	tokens float64
+	last   time.Time // When tokens was last updated.
+}
+
+// A rateLimiter applies a RateLimit to each of a set of keys, such
+// as remote IP addresses.
+type rateLimiter struct {
+	limit RateLimit
+	now   func() time.Time // Overridden in tests.
+
+	mu        sync.Mutex // Protects the items below.
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+// newRateLimiter returns a rateLimiter that applies limit to each key.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{limit: limit, now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// allow takes a token from the bucket for key and reports whether
+// one was available.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.prune(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill returns the tokens in b at time now.
+func (l *rateLimiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.limit.Rate
+	if max := float64(l.limit.Burst); tokens > max {
+		return max
+	}
+	return tokens
+}
+
+// prune removes full buckets, which behave the same as missing ones,
+// so that the limiter does not grow without bound. It runs at most
+// once a minute. It must be called with mu held.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if !l.allow("a") {
+			t.Fatalf("event %d: expected burst to be allowed", i)
+		}
+	}
+	if l.allow("a") {
+		t.Error("expected event beyond the burst to be denied")
+	}
+	if !l.allow("b") {
+		t.Error("expected other keys to have their own bucket")
+	}
+	// Two tokens are added each second.
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow("a") {
+		t.Error("expected event to be allowed once a token was added")
+	}
+	if l.allow("a") {
+		t.Error("expected event to be denied once the token was used")
+	}
+	// Full buckets are pruned.
+	now = now.Add(time.Hour)
+	l.allow("c")
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("expected full bucket to be pruned")
+	}
+}
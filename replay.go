@@ -0,0 +1,63 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import "sync"
+
+// A replayBuffer keeps the messages written to a connection until the
+// client acknowledges them, so that an application can send them again
+// if the client reconnects. Messages are numbered from 1 in the order
+// they were written.
+type replayBuffer struct {
+	mu    sync.Mutex
+	size  int      // The most messages kept; older ones are dropped.
+	first uint64   // The sequence number of msgs[0].
+	msgs  [][]byte // Unacknowledged messages, oldest first.
+}
+
+// newReplayBuffer returns an empty replayBuffer that keeps at most
+// size messages.
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{size: size, first: 1}
+}
+
+// add records a copy of msg as the next message written.
+func (b *replayBuffer) add(msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.msgs = append(b.msgs, append([]byte(nil), msg...))
+	if len(b.msgs) > b.size {
+		b.msgs[0] = nil
+		b.msgs = b.msgs[1:]
+		b.first++
+	}
+}
+
+// ack drops the messages with sequence numbers up to and including seq.
+func (b *replayBuffer) ack(seq uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq < b.first {
+		return
+	}
+	n := seq - b.first + 1
+	if n > uint64(len(b.msgs)) {
+		n = uint64(len(b.msgs))
+	}
+	for i := range b.msgs[:n] {
+		b.msgs[i] = nil
+	}
+	b.msgs = b.msgs[n:]
+	b.first += n
+}
+
+// unacked returns the sequence number of the oldest message kept and
+// the messages kept, oldest first.
+func (b *replayBuffer) unacked() (uint64, [][]byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.first, append([][]byte(nil), b.msgs...)
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	b := newReplayBuffer(3)
+	for i := 1; i <= 4; i++ {
+		b.add([]byte(strconv.Itoa(i)))
+	}
+	// The oldest message is dropped once the buffer is full.
+	seq, msgs := b.unacked()
+	if expected := [][]byte{[]byte("2"), []byte("3"), []byte("4")}; seq != 2 || !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected %q from 2, got %q from %d", expected, msgs, seq)
+	}
+	b.ack(1)
+	if seq, _ := b.unacked(); seq != 2 {
+		t.Errorf("expected an ack of a dropped message to change nothing, got %d", seq)
+	}
+	b.ack(3)
+	seq, msgs = b.unacked()
+	if expected := [][]byte{[]byte("4")}; seq != 4 || !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected %q from 4, got %q from %d", expected, msgs, seq)
+	}
+	b.ack(10)
+	if seq, msgs := b.unacked(); seq != 5 || len(msgs) != 0 {
+		t.Errorf("expected nothing kept from 5, got %q from %d", msgs, seq)
+	}
+	b.add([]byte("5"))
+	if seq, msgs := b.unacked(); seq != 5 || len(msgs) != 1 {
+		t.Errorf("expected one message from 5, got %q from %d", msgs, seq)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import "sync"
+
+// A roomSet groups connections into named rooms so that messages can
+// be broadcast to every member of a room.
+type roomSet struct {
+	mu     sync.RWMutex
+	rooms  map[string]map[*conn]struct{} // Members keyed by room.
+	joined map[*conn]map[string]struct{} // Rooms keyed by member.
+}
+
+// newRoomSet returns an empty roomSet.
+func newRoomSet() *roomSet {
+	return &roomSet{
+		rooms:  map[string]map[*conn]struct{}{},
+		joined: map[*conn]map[string]struct{}{},
+	}
+}
+
+// join adds c to the given room. Closed connections are not added.
+func (r *roomSet) join(room string, c *conn) {
+	if c.isClosed() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rooms[room] == nil {
+		r.rooms[room] = map[*conn]struct{}{}
+	}
+	r.rooms[room][c] = struct{}{}
+	if r.joined[c] == nil {
+		r.joined[c] = map[string]struct{}{}
+	}
+	r.joined[c][room] = struct{}{}
+}
+
+// leave removes c from the given room.
+func (r *roomSet) leave(room string, c *conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remove(room, c)
+	delete(r.joined[c], room)
+	if len(r.joined[c]) == 0 {
+		delete(r.joined, c)
+	}
+}
+
+// leaveAll removes c from every room it has joined.
+func (r *roomSet) leaveAll(c *conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for room := range r.joined[c] {
+		r.remove(room, c)
+	}
+	delete(r.joined, c)
+}
+
+// remove removes c from the members of room, deleting the room once
+// it is empty. It must be called with mu held.
+func (r *roomSet) remove(room string, c *conn) {
+	delete(r.rooms[room], c)
+	if len(r.rooms[room]) == 0 {
+		delete(r.rooms, room)
+	}
+}
+
+// members returns the connections in the given room.
+func (r *roomSet) members(room string) []*conn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	conns := make([]*conn, 0, len(r.rooms[room]))
+	for c := range r.rooms[room] {
+		conns = append(conns, c)
+	}
+	return conns
+}
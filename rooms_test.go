@@ -0,0 +1,32 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import "testing"
+
+func TestRoomSet(t *testing.T) {
+	r := newRoomSet()
+	c1, c2 := newConn(), newConn()
+	r.join("a", c1)
+	r.join("a", c2)
+	r.join("b", c1)
+	if n := len(r.members("a")); n != 2 {
+		t.Errorf("expected 2 members of room a, got %d", n)
+	}
+	r.leave("a", c2)
+	if m := r.members("a"); len(m) != 1 || m[0] != c1 {
+		t.Errorf("expected only c1 in room a, got %v", m)
+	}
+	r.leaveAll(c1)
+	if len(r.rooms) != 0 || len(r.joined) != 0 {
+		t.Errorf("expected empty rooms to be removed, got %v and %v", r.rooms, r.joined)
+	}
+	c2.Close()
+	r.join("a", c2)
+	if n := len(r.members("a")); n != 0 {
+		t.Errorf("expected closed conn not to join, got %d members", n)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// The kinds of message exchanged by an RPC.
+const (
+	rpcRequest byte = 'q'
+	rpcReply   byte = 'r'
+	rpcError   byte = 'e'
+)
+
+// rpcBusy is the data of the error reply sent for a request that is
+// dropped because too many are waiting for Recv.
+const rpcBusy = "busy"
+
+// ErrRPCBusy is returned by Request when the peer dropped the request
+// because too many of its requests were waiting for Recv.
+var ErrRPCBusy = errors.New("RPC peer is busy")
+
+// errRPCFormat is returned when a message is not framed as an RPC.
+var errRPCFormat = errors.New("message is not an RPC request or reply")
+
+// An rpcResult is the reply to a request, or the error the peer
+// answered it with.
+type rpcResult struct {
+	data []byte
+	err  error
+}
+
+// An RPC exchanges requests and replies over a Conn, matching each
+// reply to its request so that several can be outstanding at once.
+//
+// Each request or reply is carried in a single message, framed as
+// its kind, 'q' for a request, 'r' for a reply or 'e' for an error
+// reply, then the decimal ID of the request, a colon and the data.
+// For instance, "q7:hello" is answered by "r7:" followed by the reply.
+// The peer must use the same framing; messages that are not framed
+// this way are dropped.
+//
+// Once an RPC is created, it reads every message from the connection,
+// so the connection should not be read from directly. Requests from
+// the peer wait in a small queue for Recv. A request that arrives
+// while the queue is full is dropped and answered with the error reply
+// "busy", for which Request returns ErrRPCBusy, so that unread
+// requests never hold up the replies to this side’s own. Recv should
+// be called continually unless the peer sends no requests.
+type RPC struct {
+	c        *Conn
+	requests chan *RPCCall // Requests received from the peer.
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan rpcResult // Awaiting replies, by request ID.
+	err     error                     // The error that ended the read loop.
+}
+
+// An RPCCall is a request received from the peer.
+type RPCCall struct {
+	Data []byte // The data of the request.
+
+	rpc *RPC
+	id  uint64
+}
+
+// NewRPC returns an RPC that exchanges requests and replies over c,
+// and starts reading messages from c.
+func NewRPC(c *Conn) *RPC {
+	r := &RPC{
+		c:        c,
+		requests: make(chan *RPCCall, defaultRecvQueueSize),
+		pending:  map[uint64]chan rpcResult{},
+	}
+	go r.readLoop()
+	return r
+}
+
+// Request sends data to the peer as a request and waits for its reply.
+// It returns ctx’s error if ctx is done first, and the connection’s
+// error, such as io.EOF, if it is closed first. It returns ErrRPCBusy
+// if the peer had too many requests waiting to accept this one.
+func (r *RPC) Request(ctx context.Context, data []byte) ([]byte, error) {
+	reply := make(chan rpcResult, 1)
+	r.mu.Lock()
+	if r.err != nil {
+		r.mu.Unlock()
+		return nil, r.err
+	}
+	r.nextID++
+	id := r.nextID
+	r.pending[id] = reply
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, id)
+		r.mu.Unlock()
+	}()
+	if err := r.send(rpcRequest, id, data); err != nil {
+		return nil, err
+	}
+	select {
+	case res, ok := <-reply:
+		if !ok {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return nil, r.err
+		}
+		return res.data, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Recv returns the next request received from the peer, which should
+// be answered with Reply. It returns the connection’s error, such as
+// io.EOF, once the connection is closed.
+func (r *RPC) Recv() (*RPCCall, error) {
+	call, ok := <-r.requests
+	if !ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return nil, r.err
+	}
+	return call, nil
+}
+
+// Reply sends data to the peer as the reply to the request.
+func (call *RPCCall) Reply(data []byte) error {
+	return call.rpc.send(rpcReply, call.id, data)
+}
+
+// send writes a message of the given kind to the connection.
+func (r *RPC) send(kind byte, id uint64, data []byte) error {
+	b := append([]byte{kind}, strconv.FormatUint(id, 10)...)
+	b = append(b, ':')
+	b = append(b, data...)
+	_, err := r.c.Write(b)
+	return err
+}
+
+// readLoop reads messages from the connection, passing replies to the
+// requests awaiting them and requests to Recv, until it is closed.
+func (r *RPC) readLoop() {
+	var err error
+	for {
+		var msg []byte
+		if msg, err = r.c.ReadMessage(); err != nil {
+			break
+		}
+		kind, id, data, perr := parseRPC(msg)
+		if perr != nil {
+			r.c.c.warningf("dropping message: %v", perr)
+			continue
+		}
+		if kind == rpcRequest {
+			select {
+			case r.requests <- &RPCCall{Data: data, rpc: r, id: id}:
+			default:
+				r.c.c.warningf("dropping RPC request %d: too many are waiting for Recv", id)
+				// The sender is told, rather than left waiting
+				// until its ctx is done.
+				if err := r.send(rpcError, id, []byte(rpcBusy)); err != nil {
+					r.c.c.warningf("could not reject RPC request %d: %v", id, err)
+				}
+			}
+			continue
+		}
+		res := rpcResult{data: data}
+		if kind == rpcError {
+			res = rpcResult{err: ErrRPCBusy}
+			if string(data) != rpcBusy {
+				res.err = errors.New(string(data))
+			}
+		}
+		r.mu.Lock()
+		reply, ok := r.pending[id]
+		delete(r.pending, id)
+		r.mu.Unlock()
+		if ok {
+			reply <- res
+		}
+	}
+	r.mu.Lock()
+	r.err = err
+	for id, reply := range r.pending {
+		close(reply)
+		delete(r.pending, id)
+	}
+	r.mu.Unlock()
+	close(r.requests)
+}
+
+// parseRPC returns the kind, request ID and data of msg.
+func parseRPC(msg []byte) (kind byte, id uint64, data []byte, err error) {
+	i := bytes.IndexByte(msg, ':')
+	if i < 1 || msg[0] != rpcRequest && msg[0] != rpcReply && msg[0] != rpcError {
+		return 0, 0, nil, errRPCFormat
+	}
+	if id, err = strconv.ParseUint(string(msg[1:i]), 10, 64); err != nil {
+		return 0, 0, nil, errRPCFormat
+	}
+	return msg[0], id, msg[i+1:], nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRPC(t *testing.T) {
+	client, server := NewPipeConn()
+	rc, rs := NewRPC(client), NewRPC(server)
+	// Replies are sent in the reverse order of the requests, so that
+	// each must be matched to its request by ID.
+	const n = 5
+	go func() {
+		var calls []*RPCCall
+		for len(calls) < n {
+			call, err := rs.Recv()
+			if err != nil {
+				return
+			}
+			calls = append(calls, call)
+		}
+		for i := len(calls) - 1; i >= 0; i-- {
+			calls[i].Reply(bytes.ToUpper(calls[i].Data))
+		}
+	}()
+	// A message that is not framed as an RPC is dropped.
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(req string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			reply, err := rc.Request(ctx, []byte(req))
+			if err != nil {
+				t.Errorf("request %q failed: %v", req, err)
+				return
+			}
+			if expected := "REQ:" + req[4:]; string(reply) != expected {
+				t.Errorf("expected reply %q, got %q", expected, reply)
+			}
+		}("req:" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	// A request that is not answered gives up when ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := rc.Request(ctx, []byte("unanswered")); err != context.DeadlineExceeded {
+		t.Errorf("expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Closing the connection fails pending requests.
+	errs := make(chan error, 1)
+	go func() {
+		_, err := rc.Request(context.Background(), []byte("pending"))
+		errs <- err
+	}()
+	for _, expected := range []string{"unanswered", "pending"} {
+		call, err := rs.Recv()
+		if err != nil {
+			t.Fatalf("could not receive request: %v", err)
+		}
+		if string(call.Data) != expected {
+			t.Fatalf("expected request %q, got %q", expected, call.Data)
+		}
+	}
+	server.Close()
+	select {
+	case err := <-errs:
+		if err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected pending request to fail once the connection closed")
+	}
+	if _, err := rs.Recv(); err != io.EOF {
+		t.Errorf("expected io.EOF from Recv, got %v", err)
+	}
+	if _, err := rc.Request(context.Background(), nil); err != io.EOF {
+		t.Errorf("expected io.EOF from Request, got %v", err)
+	}
+}
+
+func TestRPCUnreadRequests(t *testing.T) {
+	client, server := NewPipeConn()
+	defer client.Close()
+	rc, rs := NewRPC(client), NewRPC(server)
+	// The server does not call Recv, but the requests waiting for it
+	// must not keep the reply to its own request from being read.
+	var reqs [][]byte
+	for i := 0; i <= defaultRecvQueueSize; i++ {
+		reqs = append(reqs, []byte("q"+strconv.Itoa(i+100)+":unread"))
+	}
+	if err := client.WriteBatch(reqs); err != nil {
+		t.Fatalf("could not write requests: %v", err)
+	}
+	go func() {
+		for {
+			call, err := rc.Recv()
+			if err != nil {
+				return
+			}
+			call.Reply(bytes.ToUpper(call.Data))
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply, err := rs.Request(ctx, []byte("hello"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if string(reply) != "HELLO" {
+		t.Errorf("expected reply %q, got %q", "HELLO", reply)
+	}
+}
+
+func TestRPCBusy(t *testing.T) {
+	client, server := NewPipeConn()
+	defer client.Close()
+	rc, _ := NewRPC(client), NewRPC(server)
+	// The server does not call Recv, so once its queue is full it
+	// answers further requests with an error rather than dropping them
+	// silently.
+	var reqs [][]byte
+	for i := 0; i < defaultRecvQueueSize; i++ {
+		reqs = append(reqs, []byte("q"+strconv.Itoa(i+100)+":unread"))
+	}
+	if err := client.WriteBatch(reqs); err != nil {
+		t.Fatalf("could not write requests: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := rc.Request(ctx, []byte("hello")); err != ErrRPCBusy {
+		t.Errorf("expected error %v, got %v", ErrRPCBusy, err)
+	}
+}
+
+func TestParseRPC(t *testing.T) {
+	for msg, ok := range map[string]bool{
+		"q1:data":  true,
+		"r42:":     true,
+		"e3:busy":  true,
+		"q1:a:b":   true,
+		"x1:data":  false,
+		"q:data":   false,
+		"qa:data":  false,
+		"q1":       false,
+		"":         false,
+		"r-1:data": false,
+	} {
+		if _, _, _, err := parseRPC([]byte(msg)); (err == nil) != ok {
+			t.Errorf("%q: expected valid to be %v, got error %v", msg, ok, err)
+		}
+	}
+}
@@ -6,19 +6,44 @@
 package ftc
 
 import (
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
-	"code.google.com/p/go.net/websocket"
 
+	"code.google.com/p/go.net/websocket"
 	"github.com/golang/glog"
 )
 
-var numClients = expvar.NewInt("num_clients")
+var (
+	numClients         = expvar.NewInt("num_clients")
+	numHandshakes      = expvar.NewInt("num_handshakes")       // Connections opened.
+	numUpgrades        = expvar.NewInt("num_upgrades")         // Polling connections upgraded to WebSocket.
+	numUpgradeFailures = expvar.NewInt("num_upgrade_failures") // Upgrades abandoned before completing.
+	// numClientsByTransport holds the number of open connections
+	// using each transport.
+	numClientsByTransport = expvar.NewMap("num_clients_by_transport")
+)
+
+// ErrKicked is the cause given to the OnClose option when a
+// connection is closed by Disconnect.
+var ErrKicked = errors.New("connection was disconnected by the server")
+
+var errNoSessionID = errors.New("could not generate an unused session ID")
+
+// errPayloadTooLarge is returned when a polling request body is larger
+// than the MaxPayloadSize option allows.
+var errPayloadTooLarge = errors.New("payload exceeds maximum size")
 
 const (
 	// Protocol error codes and mappings.
@@ -26,17 +51,24 @@ const (
 	errorUnknownSID         = 1
 	errorBadHandshakeMethod = 2
 	errorBadRequest         = 3
+	errorUnsupportedVersion = 5
+	errorOverlappingPoll    = 6
 
 	// Query parameters used in client requests.
 	paramTransport = "transport"
 	paramSessionID = "sid"
+	paramProtocol  = "EIO"
+	paramBase64    = "b64"
+	// Set to 1 on a WebSocket request by clients that may batch
+	// several packets into a frame using the payload encoding.
+	paramBatch = "batch"
 
 	// Available transports.
 	transportWebSocket = "websocket"
 	transportPolling   = "polling"
 
-	// The default time before closed connections are cleaned from
-	// the client pool.
+	// The default interval at which closed connections are swept
+	// from the client pool.
 	clientReapTimeout = 5 * time.Second
 )
 
@@ -45,6 +77,8 @@ var errorMessage = map[int]string{
 	errorUnknownSID:         "Session ID unknown",
 	errorBadHandshakeMethod: "Bad handshake method",
 	errorBadRequest:         "Bad request",
+	errorUnsupportedVersion: "Unsupported protocol version",
+	errorOverlappingPoll:    "Overlapping poll",
 }
 
 var (
@@ -58,8 +92,12 @@ var (
 )
 
 // getValidUpgrades returns a slice containing the valid protocols
-// that a connection can upgrade to.
-func getValidUpgrades() []string {
+// that a connection can upgrade to, which is empty if upgrades are
+// disabled.
+func (s *server) getValidUpgrades() []string {
+	if s.disableUpgrades {
+		return []string{}
+	}
 	upgrades := make([]string, len(validUpgrades))
 	i := 0
 	for u := range validUpgrades {
@@ -70,32 +108,262 @@ func getValidUpgrades() []string {
 }
 
 // A Handler is called by the server when a connection is
-// opened successfully.
+// opened successfully. As with an http.Handler, the connection is
+// closed once the Handler returns, so it should return only when it
+// is done with the connection; one that passes the connection to other
+// goroutines can block on Conn.Done until it closes. If it panics, the
+// connection is closed and the panic is passed to the OnClose option
+// as the cause.
 type Handler func(*Conn)
 
+// A HandlerFunc is called by the server when a connection is opened
+// successfully. The connection is closed once it returns, as for a
+// Handler. If it returns an error or panics, the error is passed to
+// the OnClose option as the cause.
+type HandlerFunc func(*Conn) error
+
 type server struct {
 	// Handler handles an FTC connection.
 	Handler
+	handlerFunc HandlerFunc
 
-	basePath   string
-	cookieName string
+	basePath         string
+	cookieName       string
+	logger           Logger
+	maxPayloadSize   int64
+	reapInterval     time.Duration
+	pingInterval     time.Duration
+	pingTimeout      time.Duration
+	upgradeTimeout   time.Duration
+	handshakeTimeout time.Duration
+	upgradeDelay     time.Duration
+	sendQueueSize    int
+	recvQueueSize    int
+	idleTimeout      time.Duration
+	protocolVersion  int
+	replayBufferSize int
+	errorMessages    map[int]string
+	idGenerator      func() string
+	authenticateFunc func(*http.Request) error
+	compress         bool
+	coalesceDelay    time.Duration
+	maxMessageSize   int64
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	handshakeExtras  func(*http.Request) map[string]interface{}
+	onUpgrade        func(*Conn)
+	wsKeepalive      time.Duration
+	disableUpgrades  bool
+	responseHeaders  http.Header
+	corsMaxAge       time.Duration
+	onClose          func(*Conn, error)
+	onPacket         func(*Conn, PacketType, []byte) bool
+	sessions         SessionStore
+	serverID         string
+	handshakeLimiter *rateLimiter
+	trustedProxies   []*net.IPNet
+	deliveryTimeout  time.Duration // How long a received message waits to be read.
 
 	clients  *clientSet        // The set of connections (some may be closed).
+	rooms    *roomSet          // The rooms joined by connections.
+	reapc    chan *conn        // Receives connections as they close.
 	wsServer *websocket.Server // The underlying WebSocket server.
+	started  time.Time         // When the server was created.
+	draining int32             // Set atomically by Drain.
+
+	middleware []func(http.Handler) http.Handler // Added by Use.
+	handler    http.Handler                      // Runs the middleware, then serveTransport.
 }
 
 // The defaults for options passed to the server.
 const (
-	defaultBasePath   = "/engine.io/"
-	defaultCookieName = "io"
+	defaultBasePath       = "/engine.io/"
+	defaultCookieName     = "io"
+	defaultMaxPayloadSize = 1 << 20
+	defaultPingInterval   = 25 * time.Second
+	defaultPingTimeout    = 60 * time.Second
+	defaultUpgradeTimeout = 10 * time.Second
+	defaultCORSMaxAge     = 10 * time.Minute
+
+	// The number of session IDs generated for each new connection
+	// before giving up on finding an unused one.
+	maxIDAttempts = 3
+
+	// Polling responses smaller than this many bytes are never compressed.
+	compressionThreshold = 1024
+
+	// The number of closed connections that can be waiting to be
+	// removed from the client set before falling back to the sweep.
+	reapQueueSize = 128
 )
 
 // Options are the parameters passed to the server.
 type Options struct {
 	// BasePath is the base URL path that the server handles requests for.
+	// Requests are routed by their transport alone, so the server may
+	// also be mounted under a different or stripped prefix, or under
+	// several prefixes at once by registering it with a ServeMux for
+	// each; the connections made through any of them are shared.
 	BasePath string
 	// CookieName is the name of the cookie set upon successful handshake.
 	CookieName string
+	// Logger receives the log output of the server and its connections.
+	// If nil, output is written to glog.
+	Logger Logger
+	// MaxPayloadSize is the largest polling request body, and the largest
+	// WebSocket packet, in bytes, that the server will accept. The
+	// websocket package reads a frame whole before it can be measured,
+	// so an oversized frame closes its connection but is still read into
+	// memory first; a proxy in front of the server can bound frame sizes.
+	MaxPayloadSize int64
+	// ReapInterval is how often closed connections are swept from the
+	// client set. Connections that close cleanly are removed right away;
+	// the sweep catches any that did not.
+	ReapInterval time.Duration
+	// PingInterval is how often the server pings each client.
+	PingInterval time.Duration
+	// PingTimeout is how long the server waits for a pong after
+	// pinging a client before closing the connection.
+	PingTimeout time.Duration
+	// UpgradeTimeout is how long the server waits for a client to
+	// complete an upgrade to WebSocket once it has opened one. If the
+	// upgrade does not complete in time, the WebSocket is closed and
+	// the connection carries on over polling.
+	UpgradeTimeout time.Duration
+	// HandshakeTimeout is how long a WebSocket opened to upgrade a
+	// connection waits for the client’s probe before it is closed,
+	// so that clients that stall cannot tie it up for the whole
+	// UpgradeTimeout. It defaults to, and cannot exceed, UpgradeTimeout.
+	// A WebSocket that connects directly sends no probe; a client that
+	// stalls on one is closed once the PingTimeout elapses.
+	HandshakeTimeout time.Duration
+	// UpgradeDelay, if positive, keeps each connection on polling for
+	// at least this long after its handshake, for instance so that the
+	// first messages are sent cheaply over polling. The probe of a
+	// client that opens a WebSocket sooner is not answered until the
+	// delay has elapsed, so the client carries on polling meanwhile;
+	// an upgrade packet sent sooner waits likewise. UpgradeTimeout is
+	// then counted from the end of the delay.
+	UpgradeDelay time.Duration
+	// SendQueueSize is the number of messages that can be waiting to be
+	// sent to a polling client. Once the queue is full, writes to the
+	// connection fail with ErrBackpressure until the client catches up.
+	SendQueueSize int
+	// RecvQueueSize is the number of received messages that can be
+	// waiting to be read by the handler. Once the queue is full, the
+	// server waits for room, and closes the connection if the handler
+	// does not read a message in time.
+	RecvQueueSize int
+	// IdleTimeout, if positive, is how long a connection may go without
+	// exchanging a message or receiving a ping from the client before
+	// it is closed. Pongs answering the server’s heartbeat do not count,
+	// so connections that are alive but unused are closed too. Idle
+	// connections are found by the sweep run every ReapInterval.
+	IdleTimeout time.Duration
+	// ProtocolVersion, if set, is the engine.io protocol version spoken
+	// by clients. Requests whose EIO parameter gives another version
+	// are rejected with an unsupported protocol version error, rather
+	// than receiving payloads they would misread. Requests without the
+	// parameter are accepted.
+	ProtocolVersion int
+	// ErrorMessages holds the messages sent with error codes, for
+	// instance to translate them or to describe the application’s own
+	// codes. They replace the server’s messages for the same codes.
+	ErrorMessages map[int]string
+	// ReplayBufferSize, if positive, is the number of messages written
+	// to each connection that are kept until the application reports,
+	// with Conn.Ack, that the client received them. See Conn.Unacked.
+	ReplayBufferSize int
+	// EnableCompression, if true, gzips polling responses of at least
+	// 1KB when the client accepts gzip encoding.
+	EnableCompression bool
+	// CoalesceDelay is how long a poll waits, once a message is ready
+	// for the client, for further messages to send in the same
+	// response. Every message already waiting is always sent together.
+	CoalesceDelay time.Duration
+	// MaxMessageSize, if positive, is the size in bytes of the largest
+	// message that may be written to a connection. Larger writes fail
+	// with ErrMessageTooLarge.
+	MaxMessageSize int64
+	// ReadTimeout, if positive, is how long a read from a connection
+	// waits for a message before failing with ErrReadTimeout. By
+	// default, reads wait until a message arrives or the connection
+	// is closed; an idle connection is kept alive by pings.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long a write to an upgraded connection may
+	// take, so that a client that stops reading cannot hold up the
+	// writer indefinitely. A write that times out fails and closes the
+	// connection. It defaults to 30 seconds; if negative, writes have
+	// no deadline. Writes to polling clients never block; they fail
+	// with ErrBackpressure instead.
+	WriteTimeout time.Duration
+	// HandshakeExtras, if set, is called with the request of each
+	// handshake and returns extra fields to add to the handshake data
+	// sent in the open packet. Fields the server sets itself, such as
+	// sid and upgrades, cannot be replaced.
+	HandshakeExtras func(r *http.Request) map[string]interface{}
+	// OnUpgrade, if set, is called in its own goroutine once a polling
+	// connection has been upgraded to a WebSocket and any messages
+	// waiting for it have been sent, so writes go over the WebSocket.
+	// It is called at most once per connection.
+	OnUpgrade func(c *Conn)
+	// WSKeepalive, if positive, is the interval at which WebSocket
+	// ping frames are sent on upgraded connections, for proxies that
+	// close WebSockets without control frame traffic. It is separate
+	// from the ping packets of the heartbeat and only keeps the
+	// connection alive; clients answer with pong frames, which are
+	// discarded.
+	WSKeepalive time.Duration
+	// DisableUpgrades, if true, keeps every connection on polling.
+	// No upgrades are offered in the handshake and WebSocket requests
+	// are rejected as an unknown transport.
+	DisableUpgrades bool
+	// ResponseHeaders are set on every polling response, replacing any
+	// header of the same name that the server sets, for instance to
+	// send X-Accel-Buffering: no to nginx. Headers that vary with the
+	// request can be set by middleware added with Use.
+	ResponseHeaders http.Header
+	// CORSMaxAge is how long browsers may cache the response to a
+	// preflight request, sent as Access-Control-Max-Age, so that they
+	// do not send one before every cross-origin POST. It defaults to
+	// ten minutes; if negative, no Access-Control-Max-Age is sent.
+	CORSMaxAge time.Duration
+	// IDGenerator, if set, is called to generate the session ID of
+	// each new connection in place of the default random ID. If it
+	// returns an empty ID or one that is already in use, it is called
+	// again, and the handshake fails after a few attempts.
+	IDGenerator func() string
+	// Authenticate, if set, is called with the request of each
+	// handshake before a connection is created. If it returns an
+	// error, the handshake is rejected with a Bad request error, or
+	// with the given code if the error is an ErrorCode.
+	Authenticate func(*http.Request) error
+	// OnClose, if set, is called once a connection has closed. err is
+	// a *CloseError holding the reason for the close, the error that
+	// caused it, if any, and the data of the client’s close packet.
+	OnClose func(c *Conn, err error)
+	// OnPacket, if set, is called with each packet received from a
+	// client before it is handled, including pings, pongs and the
+	// upgrade packet. If it returns false, the packet is not handled
+	// further. The probe exchanged on a WebSocket before an upgrade
+	// completes is not passed to OnPacket.
+	OnPacket func(c *Conn, typ PacketType, data []byte) bool
+	// SessionStore records the sessions owned by the server. It may
+	// be shared by several servers. If nil, an in-memory store is used.
+	SessionStore SessionStore
+	// ServerID identifies the server in the SessionStore. It defaults
+	// to the host name.
+	ServerID string
+	// HandshakeRateLimit, if its Rate is positive, limits the rate of
+	// handshakes from each remote IP address. Handshakes beyond the
+	// limit are rejected with a 429 Too Many Requests.
+	HandshakeRateLimit RateLimit
+	// TrustedProxies lists the proxies, as CIDR blocks or single IP
+	// addresses, whose X-Forwarded-For and X-Forwarded-Proto headers
+	// are honored. Those headers are ignored on requests from any
+	// other address, since clients can set them to anything. Entries
+	// that cannot be parsed are logged and skipped.
+	TrustedProxies []string
 }
 
 // NewServer allocates and returns a new server with the given
@@ -112,81 +380,409 @@ func NewServer(o *Options, h Handler) *server {
 	if len(opts.CookieName) == 0 {
 		opts.CookieName = defaultCookieName
 	}
+	if opts.Logger == nil {
+		opts.Logger = glogLogger{}
+	}
+	if opts.MaxPayloadSize <= 0 {
+		opts.MaxPayloadSize = defaultMaxPayloadSize
+	}
+	if opts.ReapInterval <= 0 {
+		opts.ReapInterval = clientReapTimeout
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = defaultPingInterval
+	}
+	if opts.PingTimeout <= 0 {
+		opts.PingTimeout = defaultPingTimeout
+	}
+	if opts.UpgradeTimeout <= 0 {
+		opts.UpgradeTimeout = defaultUpgradeTimeout
+	}
+	if opts.HandshakeTimeout <= 0 || opts.HandshakeTimeout > opts.UpgradeTimeout {
+		opts.HandshakeTimeout = opts.UpgradeTimeout
+	}
+	if opts.SendQueueSize <= 0 {
+		opts.SendQueueSize = defaultSendQueueSize
+	}
+	if opts.RecvQueueSize <= 0 {
+		opts.RecvQueueSize = defaultRecvQueueSize
+	}
+	if opts.CORSMaxAge == 0 {
+		opts.CORSMaxAge = defaultCORSMaxAge
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = defaultTimeout
+	}
+	if opts.SessionStore == nil {
+		opts.SessionStore = newMemorySessionStore()
+	}
+	if len(opts.ServerID) == 0 {
+		opts.ServerID, _ = os.Hostname()
+	}
+	var handshakeLimiter *rateLimiter
+	if opts.HandshakeRateLimit.Rate > 0 {
+		handshakeLimiter = newRateLimiter(opts.HandshakeRateLimit)
+	}
 	s := &server{
-		Handler:    h,
-		basePath:   opts.BasePath,
-		cookieName: opts.CookieName,
-		clients:    &clientSet{clients: map[string]*conn{}},
+		Handler:          h,
+		basePath:         opts.BasePath,
+		cookieName:       opts.CookieName,
+		logger:           opts.Logger,
+		maxPayloadSize:   opts.MaxPayloadSize,
+		reapInterval:     opts.ReapInterval,
+		pingInterval:     opts.PingInterval,
+		pingTimeout:      opts.PingTimeout,
+		upgradeTimeout:   opts.UpgradeTimeout,
+		handshakeTimeout: opts.HandshakeTimeout,
+		upgradeDelay:     opts.UpgradeDelay,
+		sendQueueSize:    opts.SendQueueSize,
+		recvQueueSize:    opts.RecvQueueSize,
+		idleTimeout:      opts.IdleTimeout,
+		protocolVersion:  opts.ProtocolVersion,
+		replayBufferSize: opts.ReplayBufferSize,
+		errorMessages:    map[int]string{},
+		compress:         opts.EnableCompression,
+		coalesceDelay:    opts.CoalesceDelay,
+		maxMessageSize:   opts.MaxMessageSize,
+		readTimeout:      opts.ReadTimeout,
+		writeTimeout:     opts.WriteTimeout,
+		handshakeExtras:  opts.HandshakeExtras,
+		onUpgrade:        opts.OnUpgrade,
+		wsKeepalive:      opts.WSKeepalive,
+		disableUpgrades:  opts.DisableUpgrades,
+		responseHeaders:  opts.ResponseHeaders,
+		corsMaxAge:       opts.CORSMaxAge,
+		idGenerator:      opts.IDGenerator,
+		authenticateFunc: opts.Authenticate,
+		onClose:          opts.OnClose,
+		onPacket:         opts.OnPacket,
+		sessions:         opts.SessionStore,
+		serverID:         opts.ServerID,
+		handshakeLimiter: handshakeLimiter,
+		deliveryTimeout:  defaultTimeout,
+		clients:          newClientSet(),
+		rooms:            newRoomSet(),
+		reapc:            make(chan *conn, reapQueueSize),
+		started:          time.Now(),
+	}
+	for code, msg := range errorMessage {
+		s.errorMessages[code] = msg
+	}
+	for code, msg := range opts.ErrorMessages {
+		s.errorMessages[code] = msg
+	}
+	for _, proxy := range opts.TrustedProxies {
+		if n := parseCIDR(proxy); n != nil {
+			s.trustedProxies = append(s.trustedProxies, n)
+		} else {
+			s.logger.Errorf("invalid trusted proxy %q", proxy)
+		}
 	}
+	s.handler = http.HandlerFunc(s.serveTransport)
 	go s.startReaper()
+	// TODO: Negotiate permessage-deflate once the websocket package
+	// supports extensions. It currently has no way to configure them.
 	s.wsServer = &websocket.Server{Handler: s.wsHandler}
 	return s
 }
 
-// startReaper continuously removes closed connections from the
-// client set via the reap function.
+// NewServerFunc allocates and returns a new server with the given
+// options and HandlerFunc. Options are treated as in NewServer.
+func NewServerFunc(o *Options, h HandlerFunc) *server {
+	s := NewServer(o, nil)
+	s.handlerFunc = h
+	return s
+}
+
+// newConn allocates a new connection for the handshake request r,
+// configured with the server’s options, using ws as its transport if
+// it is non-nil, and adds it to the client set. If an unused session
+// ID cannot be generated after a few attempts, an error is returned.
+// Once the open packet has been sent, the caller starts the connection
+// with start.
+func (s *server) newConn(r *http.Request, ws *websocket.Conn) (*conn, error) {
+	c := newConn()
+	c.ws = ws
+	c.forceBase64 = r.FormValue(paramBase64) == "1"
+	c.buf = make(chan []byte, s.sendQueueSize+controlQueueSize)
+	c.sendQueueSize = s.sendQueueSize
+	c.pubConn.msgs = make(chan message, s.recvQueueSize)
+	c.logger = s.logger
+	c.reapc = s.reapc
+	c.onClose = s.onClose
+	c.coalesce = s.coalesceDelay
+	c.maxMessageSize = s.maxMessageSize
+	c.readTimeout = s.readTimeout
+	c.writeTimeout = s.writeTimeout
+	c.rooms = s.rooms
+	c.metrics = true
+	c.pubConn.deliveryTimeout = s.deliveryTimeout
+	c.pubConn.userAgent = r.UserAgent()
+	if s.replayBufferSize > 0 {
+		c.pubConn.replay = newReplayBuffer(s.replayBufferSize)
+	}
+	for i := 0; ; i++ {
+		if i == maxIDAttempts {
+			return nil, errNoSessionID
+		}
+		if s.idGenerator != nil {
+			c.id = s.idGenerator()
+		} else if i > 0 {
+			c.id = newID()
+		}
+		if !s.clients.add(c) {
+			s.logger.Warningf("session ID %q is empty or in use", c.id)
+			continue
+		}
+		err := s.sessions.Add(c.id, s.serverID)
+		if err == nil {
+			break
+		}
+		s.clients.remove(c)
+		if err != ErrSessionExists {
+			return nil, err
+		}
+		s.logger.Warningf("session ID %q is in use by another server", c.id)
+	}
+	numHandshakes.Add(1)
+	if ws != nil {
+		numClientsByTransport.Add(transportWebSocket, 1)
+	} else {
+		numClientsByTransport.Add(transportPolling, 1)
+	}
+	return c, nil
+}
+
+// start begins the heartbeat of a connection whose open packet has
+// been sent and runs the server’s handler for it.
+func (s *server) start(c *conn) {
+	go c.heartbeat(s.pingInterval, s.pingTimeout)
+	go s.serve(c)
+}
+
+// startReaper removes connections from the client set as soon as
+// they signal that they have closed. Every reapInterval it also sweeps
+// the set via the reap function, as a fallback for connections that
+// closed without signaling.
 func (s *server) startReaper() {
+	if s.clients == nil {
+		glog.Fatal("server cannot have a nil client set")
+	}
+	ticker := time.NewTicker(s.reapInterval)
+	defer ticker.Stop()
 	for {
-		if s.clients == nil {
-			glog.Fatal("server cannot have a nil client set")
+		select {
+		case c := <-s.reapc:
+			s.removeConn(c)
+		case <-ticker.C:
+			for _, c := range s.clients.reap() {
+				s.removeSession(c)
+			}
+			numClients.Set(int64(s.clients.len()))
+			if s.idleTimeout > 0 {
+				s.closeIdle()
+			}
+		}
+	}
+}
+
+// closeIdle closes the connections that have been idle for longer
+// than the IdleTimeout option allows. They are closed in a separate
+// goroutine so that OnClose hooks cannot hold up the reaper.
+func (s *server) closeIdle() {
+	var idle []*conn
+	s.clients.forEach(func(c *conn) bool {
+		if c.idle() > s.idleTimeout && !c.isClosed() {
+			idle = append(idle, c)
+		}
+		return true
+	})
+	if len(idle) == 0 {
+		return
+	}
+	go func() {
+		for _, c := range idle {
+			c.infof("closing connection idle for %v", c.idle())
+			closeWithPacket(c, DisconnectIdle, nil, nil)
 		}
-		s.clients.reap()
+	}()
+}
+
+// removeConn removes a closed connection from the client set and the
+// session store, so that later requests for its session ID fail.
+func (s *server) removeConn(c *conn) {
+	if s.clients.remove(c) {
+		s.removeSession(c)
 		numClients.Set(int64(s.clients.len()))
-		time.Sleep(clientReapTimeout)
+	}
+}
+
+// startKeepalive starts sending WebSocket ping frames on c if the
+// WSKeepalive option is set.
+func (s *server) startKeepalive(c *conn) {
+	if s.wsKeepalive > 0 {
+		go c.keepalive(s.wsKeepalive)
+	}
+}
+
+// removeSession removes the session of a reaped connection from the
+// session store.
+func (s *server) removeSession(c *conn) {
+	if err := s.sessions.Remove(c.id); err != nil {
+		c.errorf("could not remove session: %v", err)
+	}
+}
+
+// logUnknownSession logs a request for a session that the server does
+// not hold, noting which server owns it if it is in the session store.
+func (s *server) logUnknownSession(id string) {
+	owner, err := s.sessions.Get(id)
+	if err != nil {
+		s.logger.Errorf("could not look up session %q: %v", id, err)
+	} else if len(owner) > 0 && owner != s.serverID {
+		s.logger.Warningf("session %q is owned by server %q", id, owner)
+	}
+}
+
+// serve runs the server’s handler for the given connection and closes
+// the connection once it returns. If the handler panics, or is a
+// HandlerFunc that returns an error, the connection is closed with
+// that error and the server carries on.
+func (s *server) serve(c *conn) {
+	if s.handlerFunc == nil && s.Handler == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			c.errorf("handler panic: %v\n%s", r, debug.Stack())
+			c.close(DisconnectHandlerError, fmt.Errorf("handler panic: %v", r))
+			return
+		}
+		// The handler is done with the connection, so let the client
+		// know rather than leaving it open until it times out.
+		if !c.isClosed() {
+			closeWithPacket(c, DisconnectHandlerReturned, nil, nil)
+		}
+	}()
+	if s.handlerFunc != nil {
+		if err := s.handlerFunc(c.pubConn); err != nil {
+			c.close(DisconnectHandlerError, err)
+		}
+		return
+	}
+	if s.Handler != nil {
+		s.Handler(c.pubConn)
 	}
 }
 
 // handlePacket takes the given packet and writes the appropriate
 // response to the given connection.
 func (s *server) handlePacket(p packet, c *conn) error {
-	glog.Infof("handling packet type: %c, data: %s, upgraded: %t", p.typ, p.data, c.upgraded())
-	var encode func(packet) error
-	if c.upgraded() {
-		encode = newPacketEncoder(c).encode
-	} else {
-		encode = func(pkt packet) error {
-			return newPayloadEncoder(c).encode([]packet{pkt})
-		}
+	c.infof("handling packet type: %c, data: %s, upgraded: %t", p.typ, p.data, c.upgraded())
+	if !s.acceptPacket(p, c) {
+		return nil
+	}
+	// A polling conn stays in the client set until its close packet
+	// is delivered, so packets can still arrive once it is closed.
+	if c.isClosed() && (p.typ == packetTypeMessage || p.typ == packetTypePing) {
+		c.infof("dropping packet type %c received after close", p.typ)
+		return nil
 	}
 	switch p.typ {
 	case packetTypePing:
-		return encode(packet{typ: packetTypePong, data: p.data})
+		// Clients that ping on their own schedule are alive too.
+		c.heard()
+		c.touch()
+		if err := c.writePacket(packet{typ: packetTypePong, data: p.data}); err != nil {
+			c.warningf("could not send pong: %v", err)
+		}
+	case packetTypePong:
+		c.heard()
 	case packetTypeMessage:
-		if c.pubConn != nil {
-			c.pubConn.onMessage(p.data)
+		if s.isDraining() {
+			c.infof("dropping message while draining")
+		} else if c.pubConn != nil {
+			return c.pubConn.onMessage(p.data, p.binary)
 		}
 	case packetTypeClose:
-		c.Close()
+		c.closeWithError(&CloseError{Reason: DisconnectClient, Data: p.data})
+		// Remove the conn now rather than leaving it for the reaper,
+		// so that no request for its session can race in meanwhile.
+		s.removeConn(c)
 	}
 	return nil
 }
 
+// acceptPacket passes p to the OnPacket option, if set, and reports
+// whether the packet should be handled as usual.
+func (s *server) acceptPacket(p packet, c *conn) bool {
+	if s.onPacket == nil {
+		return true
+	}
+	return s.onPacket(c.pubConn, PacketType(p.typ), p.data)
+}
+
 // wsHandler continuously receives on the given WebSocket
 // connection and delegates the packets received to the
 // appropriate handler functions.
+//
+// A WebSocket without a session ID connects directly: a conn is
+// created with it as its transport and the open packet is sent before
+// the heartbeat and handler start or any packet is read. Messages the
+// client sends straight away wait in the conn’s receive queue for the
+// handler.
+//
+// A WebSocket with the session ID of a polling conn is an upgrade: the
+// client’s probe ping is answered with a pong and a noop is queued to
+// end the in-flight poll. Packets are then handled as usual until the
+// upgrade packet makes the WebSocket the conn’s transport. If it
+// closes first, the conn carries on over polling.
+//
+// A client that sets the batch parameter to 1 may send several packets
+// in one text frame, such as the probe and the upgrade, using the
+// payload encoding. Frames from other clients hold a single packet.
 func (s *server) wsHandler(ws *websocket.Conn) {
 	// If the client initially attempts to connect directly using
 	// WebSocket transport, the session ID parameter will be empty.
 	// Otherwise, the connection with the given session ID will
 	// need to be upgraded.
-	glog.Infoln("Starting websocket handler...")
+	s.logger.Infof("starting websocket handler...")
 	var c *conn
+	// Whether ws is the connection’s transport, rather than a
+	// WebSocket that has yet to complete an upgrade.
+	var owned bool
+	// The error that ended the loop, if any.
+	var err error
 	wsEncoder, wsDecoder := newPacketEncoder(ws), newPacketDecoder(ws)
+	wsDecoder.maxSize = s.maxPayloadSize
+	wsDecoder.batched = ws.Request().FormValue(paramBatch) == "1"
 	for {
 		if c != nil {
 			var pkt packet
-			if err := wsDecoder.decode(&pkt); err != nil {
-				glog.Errorf("could not decode packet: %v", err)
+			if err = wsDecoder.decode(&pkt); err != nil {
+				c.errorf("could not decode packet: %v", err)
 				break
 			}
-			glog.Infof("WS: got packet type: %c, data: %s", pkt.typ, pkt.data)
+			c.infof("WS: got packet type: %c, data: %s", pkt.typ, pkt.data)
 			if pkt.typ == packetTypeUpgrade {
+				if !s.acceptPacket(pkt, c) {
+					continue
+				}
+				s.delayUpgrade(c)
 				// Upgrade the connection to use this WebSocket Conn.
-				c.upgrade(ws)
+				ws.SetReadDeadline(time.Time{})
+				if c.upgrade(ws) {
+					numUpgrades.Add(1)
+					s.startKeepalive(c)
+					if s.onUpgrade != nil {
+						go s.onUpgrade(c.pubConn)
+					}
+				}
+				owned = true
 				continue
 			}
-			if err := s.handlePacket(pkt, c); err != nil {
-				glog.Errorf("could not handle packet: %v", err)
+			if err = s.handlePacket(pkt, c); err != nil {
+				c.errorf("could not handle packet: %v", err)
 				break
 			}
 			continue
@@ -194,84 +790,185 @@ func (s *server) wsHandler(ws *websocket.Conn) {
 		id := ws.Request().FormValue(paramSessionID)
 		c = s.clients.get(id)
 		if len(id) > 0 && c == nil {
-			serverError(ws, errorUnknownSID)
+			// Unknown IDs are normally rejected before the WebSocket
+			// handshake, but the conn may have been reaped since.
+			s.logUnknownSession(id)
+			if err := wsEncoder.encode(packet{typ: packetTypeClose}); err != nil {
+				s.logger.Errorf("could not encode close packet: %v", err)
+			}
 			break
 		} else if len(id) > 0 && c != nil {
+			// Abandon the upgrade if the probe does not arrive, or the
+			// upgrade is not completed, in time.
+			deadline := time.Now().Add(s.upgradeTimeout)
+			ws.SetReadDeadline(time.Now().Add(s.handshakeTimeout))
 			// The initial handshake requires a ping (2) and pong (3) echo.
 			var pkt packet
 			if err := wsDecoder.decode(&pkt); err != nil {
-				glog.Errorf("could not decode packet: %v", err)
+				c.errorf("could not decode packet: %v", err)
 				continue
 			}
-			glog.Infof("WS: got packet type: %c, data: %s", pkt.typ, pkt.data)
+			c.infof("WS: got packet type: %c, data: %s", pkt.typ, pkt.data)
+			if s.delayUpgrade(c) {
+				deadline = time.Now().Add(s.upgradeTimeout)
+			}
+			ws.SetReadDeadline(deadline)
 			if pkt.typ == packetTypePing {
-				glog.Infof("got ping packet with data %s", pkt.data)
+				c.infof("got ping packet with data %s", pkt.data)
 				if err := wsEncoder.encode(packet{typ: packetTypePong, data: pkt.data}); err != nil {
-					glog.Errorf("could not encode pong packet: %v", err)
+					c.errorf("could not encode pong packet: %v", err)
 					continue
 				}
 				// Force a polling cycle to ensure a fast upgrade.
-				glog.Infoln("forcing polling cycle")
-				payload := []packet{packet{typ: packetTypeNoop}}
-				if err := newPayloadEncoder(c).encode(payload); err != nil {
-					glog.Errorf("could not encode packet to force polling cycle: %v", err)
+				c.infof("forcing polling cycle")
+				if err := c.writePacket(packet{typ: packetTypeNoop}); err != nil {
+					c.errorf("could not encode packet to force polling cycle: %v", err)
 					continue
 				}
 			}
 		} else if len(id) == 0 && c == nil {
-			// Create a new connection with this WebSocket Conn.
-			c = newConn()
-			c.ws = ws
-			s.clients.add(c)
-			b, err := handshakeData(c)
-			if err != nil {
-				glog.Errorf("could not get handshake data: %v", err)
-			}
-			if err := wsEncoder.encode(packet{typ: packetTypeOpen, data: b}); err != nil {
-				glog.Errorf("could not encode open packet: %v", err)
+			// Create a new connection with this WebSocket Conn. The
+			// request was authenticated before the WebSocket opened.
+			if c, err = s.newConn(ws.Request(), ws); err != nil {
+				s.logger.Errorf("could not create connection: %v", err)
 				break
 			}
-			if s.Handler != nil {
-				go s.Handler(c.pubConn)
+			owned = true
+			// The conn is already in the client set, so the write lock
+			// is held to keep other writes from overtaking the open
+			// packet. Nothing is read until it has been sent.
+			c.wmu.Lock()
+			err := wsEncoder.encode(s.openPacket(c, ws.Request()))
+			c.wmu.Unlock()
+			if err != nil {
+				c.errorf("could not encode open packet: %v", err)
+				break
 			}
+			s.startKeepalive(c)
+			s.start(c)
 		}
 	}
-	glog.Infof("closing websocket connection %p", ws)
-	c.Close()
+	s.logger.Infof("closing websocket connection %p", ws)
+	// c is nil here if the loop ended before a conn was found or
+	// created, in which case ws is not owned either.
+	if !owned {
+		// Polling remains the connection’s transport, if there is one.
+		if c != nil {
+			numUpgradeFailures.Add(1)
+		}
+		ws.Close()
+		return
+	}
+	c.closeWithError(&CloseError{Reason: DisconnectTransportError, Err: err, Code: wsCloseCode(err)})
+}
+
+// delayUpgrade blocks until the UpgradeDelay option has elapsed since
+// c’s handshake, or c closes, and reports whether it had to wait.
+func (s *server) delayUpgrade(c *conn) bool {
+	wait := s.upgradeDelay - time.Since(c.pubConn.connectedAt)
+	if wait <= 0 {
+		return false
+	}
+	c.infof("delaying upgrade for %v", wait)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.done:
+	}
+	return true
 }
 
 // pollingHandler handles all XHR polling requests to the server, initiating
 // a handshake if the request’s session ID does not already exist within
 // the client set.
 func (s *server) pollingHandler(w http.ResponseWriter, r *http.Request) {
-	setPollingHeaders(w, r)
+	s.setPollingHeaders(w, r)
 	id := r.FormValue(paramSessionID)
 	if len(id) > 0 {
 		c := s.clients.get(id)
 		if c == nil {
-			serverError(w, errorUnknownSID)
+			s.logUnknownSession(id)
+			s.serverError(w, r, errorUnknownSID)
 			return
 		}
 		if r.Method == "POST" {
 			var payload []packet
-			if err := newPayloadDecoder(r.Body).decode(&payload); err != nil {
+			dec := newPayloadDecoder(&limitedReader{r: r.Body, n: s.maxPayloadSize})
+			dec.maxSize = s.maxPayloadSize
+			if err := dec.decode(&payload); err != nil {
+				if err == errPayloadTooLarge {
+					if r.ProtoMajor == 1 {
+						// The rest of the body is left unread, so the
+						// connection cannot be reused for another
+						// request, as with http.MaxBytesReader.
+						w.Header().Set("Connection", "close")
+					}
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			defer r.Body.Close()
+			if s.isDraining() && hasMessage(payload) {
+				// Rather than drop the messages, ask the client to
+				// retry, so that it reconnects to another server.
+				c.infof("rejecting messages while draining")
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "server is draining", http.StatusServiceUnavailable)
+				return
+			}
 			for _, pkt := range payload {
-				s.handlePacket(pkt, c)
+				if err := s.handlePacket(pkt, c); err == errDeliveryTimeout {
+					// The packets that follow must not be delivered
+					// once one has been dropped, so the connection is
+					// closed and the client told to reconnect.
+					c.errorf("could not handle packet: %v", err)
+					c.close(DisconnectTransportError, err)
+					s.removeConn(c)
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				} else if err != nil {
+					c.errorf("could not handle packet: %v", err)
+				}
 			}
 			fmt.Fprintf(w, "ok")
 			return
 		} else if r.Method == "GET" {
-			glog.Infoln("GET request xhr polling data...")
-			// TODO(andybons): Requests can pile up, here. Drain the conn and
-			// then write the payload.
-			if _, err := io.Copy(w, c); err != nil {
+			c.infof("GET request xhr polling data...")
+			// A client has only one poll outstanding at a time; two
+			// would split its messages between them arbitrarily.
+			if !c.beginPoll() {
+				c.warningf("rejecting overlapping poll")
+				s.serverError(w, r, errorOverlappingPoll)
+				return
+			}
+			defer c.endPoll()
+			if c.upgraded() {
+				// Anything that was buffered has been moved to the
+				// WebSocket, so release the poll with a noop.
+				newPayloadEncoder(w).encode([]packet{packet{typ: packetTypeNoop}})
+				return
+			}
+			err := c.poll(r.Context(), func(b []byte) error {
+				return s.writePayload(w, r, b)
+			})
+			if r.Context().Err() != nil {
+				// The client has gone; anything taken will be resent.
+				return
+			}
+			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if c.isClosed() && c.queued() == 0 {
+				// The close packet has been delivered.
+				s.removeConn(c)
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
 			return
 		}
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -280,88 +977,520 @@ func (s *server) pollingHandler(w http.ResponseWriter, r *http.Request) {
 	s.pollingHandshake(w, r)
 }
 
+// hasMessage reports whether payload holds a message packet.
+func hasMessage(payload []packet) bool {
+	for _, pkt := range payload {
+		if pkt.typ == packetTypeMessage {
+			return true
+		}
+	}
+	return false
+}
+
+// A limitedReader reads from r, failing with errPayloadTooLarge once
+// more than n bytes have been read in all. It is used in place of
+// http.MaxBytesReader because the error that reader returns can only be
+// told apart from a read error by its text before http.MaxBytesError,
+// which needs Go 1.19. Unlike http.MaxBytesReader it does not close the
+// connection itself, so the handler does.
+type limitedReader struct {
+	r io.Reader
+	n int64 // The number of bytes that may still be read.
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errPayloadTooLarge
+	}
+	// Read one byte past the limit to tell a body that ends at the
+	// limit from one that goes on.
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return 0, errPayloadTooLarge
+	}
+	return n, err
+}
+
+// writePayload writes the encoded payload b in response to the polling
+// request r, compressing it if the server and client both allow it.
+func (s *server) writePayload(w http.ResponseWriter, r *http.Request, b []byte) error {
+	if !s.compress || len(b) < compressionThreshold || !acceptsGzip(r) {
+		_, err := w.Write(b)
+		return err
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	gz := gzip.NewWriter(w)
+	gz.Write(b)
+	return gz.Close()
+}
+
+// acceptsGzip returns true if the request’s Accept-Encoding header
+// lists gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			if i := strings.IndexByte(enc, ';'); i >= 0 {
+				enc = enc[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // pollingHandshake creates a new FTC Conn with the given HTTP Request and
 // ResponseWriter, setting a persistence cookie if necessary and calling
 // the server’s Handler.
 func (s *server) pollingHandshake(w http.ResponseWriter, r *http.Request) {
-	c := newConn()
-	s.clients.add(c)
+	if err := s.authenticate(r); err != nil {
+		s.logger.Warningf("polling handshake rejected: %v", err)
+		s.serverError(w, r, rejectionCode(err))
+		return
+	}
+	c, err := s.newConn(r, nil)
+	if err != nil {
+		s.logger.Errorf("could not create connection: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	if len(s.cookieName) > 0 {
 		http.SetCookie(w, &http.Cookie{
 			Name:  s.cookieName,
 			Value: c.id,
 		})
 	}
-	b, err := handshakeData(c)
-	if err != nil {
-		glog.Errorf("could not get handshake data: %v", err)
-	}
-	payload := []packet{packet{typ: packetTypeOpen, data: b}}
+	payload := []packet{s.openPacket(c, r)}
 	if err := newPayloadEncoder(w).encode(payload); err != nil {
-		glog.Errorf("could not encode open payload: %v", err)
+		c.errorf("could not encode open payload: %v", err)
+		c.close(DisconnectTransportError, err)
 		return
 	}
-	if s.Handler != nil {
-		go s.Handler(c.pubConn)
+	s.start(c)
+}
+
+// ForEach calls fn for each open connection, stopping early if fn
+// returns false. A lock on the client set is held while fn runs, so
+// fn must not block for long; handshakes and the reaper wait on it.
+func (s *server) ForEach(fn func(*Conn) bool) {
+	s.clients.forEach(func(c *conn) bool {
+		return fn(c.pubConn)
+	})
+}
+
+// BroadcastTo writes p as a message to every connection in the named
+// room. A connection whose write fails, for instance because its send
+// queue is full, misses the message; the failure is logged.
+func (s *server) BroadcastTo(room string, p []byte) {
+	for _, c := range s.rooms.members(room) {
+		if _, err := c.pubConn.Write(p); err != nil {
+			c.warningf("could not broadcast to room %q: %v", room, err)
+		}
 	}
 }
 
+// Disconnect sends a close packet to the connection with the given
+// session ID and closes it, passing ErrKicked to the OnClose option.
+// It returns false if no open connection has that ID.
+func (s *server) Disconnect(id string) bool {
+	c := s.clients.get(id)
+	if c == nil || c.isClosed() {
+		return false
+	}
+	return closeWithPacket(c, DisconnectKicked, ErrKicked, nil) == nil
+}
+
+// DisconnectWhere sends a close packet to every open connection for
+// which pred returns true and closes it, passing ErrKicked to the
+// OnClose option, as Disconnect does. It returns the number of
+// connections closed. pred is called without the client set locked,
+// so it may use the server, and connections that close concurrently
+// are skipped and not counted.
+func (s *server) DisconnectWhere(pred func(*Conn) bool) int {
+	var conns []*conn
+	s.clients.forEach(func(c *conn) bool {
+		conns = append(conns, c)
+		return true
+	})
+	n := 0
+	for _, c := range conns {
+		if c.isClosed() || !pred(c.pubConn) {
+			continue
+		}
+		if closeWithPacket(c, DisconnectKicked, ErrKicked, nil) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Shutdown sends a close packet to every open connection and closes
+// it, passing DisconnectShutdown to the OnClose option. It does not
+// stop the server from accepting new connections.
+func (s *server) Shutdown() {
+	var conns []*conn
+	s.clients.forEach(func(c *conn) bool {
+		conns = append(conns, c)
+		return true
+	})
+	for _, c := range conns {
+		closeWithPacket(c, DisconnectShutdown, nil, nil)
+	}
+}
+
+// Drain stops the server from accepting new connections and messages
+// so that it can be taken out of service. Handshakes are refused with
+// a 503 Service Unavailable so that clients reconnect to another
+// server. So are polling requests that send messages, none of which
+// are delivered, so that the client retries them elsewhere; messages
+// received over a WebSocket are dropped. Existing connections remain
+// open and keep delivering what is written to them until they are
+// closed, for instance by Shutdown. The HealthHandler also responds
+// with a 503 while the server drains.
+func (s *server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// isDraining reports whether Drain has been called.
+func (s *server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+// closeWithPacket sends a close packet carrying data to the client and
+// closes c.
+func closeWithPacket(c *conn, reason DisconnectReason, err error, data []byte) error {
+	if c.upgraded() {
+		if err := c.writePacket(packet{typ: packetTypeClose, data: data}); err != nil {
+			c.errorf("could not send close packet: %v", err)
+		}
+	} else {
+		// Polling clients are sent a close packet by close.
+		c.mu.Lock()
+		c.closeData = data
+		c.mu.Unlock()
+	}
+	return c.close(reason, err)
+}
+
+// HealthHandler returns a handler that responds with 200, or 503 once
+// the server is draining, and a JSON body holding the server’s uptime
+// in seconds, its number of connections and whether it is draining.
+// It is intended to be mounted outside of the base path for use by
+// load balancer health checks.
+func (s *server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		draining := s.isDraining()
+		if draining {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(struct {
+			Uptime      int64 `json:"uptime"`
+			Connections int   `json:"connections"`
+			Draining    bool  `json:"draining"`
+		}{
+			int64(time.Since(s.started) / time.Second),
+			s.clients.len(),
+			draining,
+		})
+	})
+}
+
 // ServeHTTP implements the http.Handler interface for an FTC Server.
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	remoteAddr := r.Header.Get("X-Forwarded-For")
-	if len(remoteAddr) == 0 {
-		remoteAddr = r.RemoteAddr
-	}
-	glog.Infof("%s (%s) %s %s %s", r.Proto, r.Header.Get("X-Forwarded-Proto"), r.Method, remoteAddr, r.URL)
+	s.logger.Infof("%s (%s) %s %s %s", r.Proto, s.forwardedProto(r), r.Method, s.remoteAddr(r), r.URL)
 
-	transport := r.FormValue(paramTransport)
-	if strings.HasPrefix(r.URL.Path, s.basePath) && !validTransports[transport] {
-		serverError(w, errorTransportUnknown)
+	transport := transportParam(r)
+	// The path is not checked, so that the server can be mounted by a
+	// router that rewrites it, such as http.StripPrefix.
+	if !validTransports[transport] || s.disableUpgrades && transport == transportWebSocket {
+		s.serverError(w, r, errorTransportUnknown)
+		return
+	}
+	if !s.supportsProtocol(r) {
+		s.serverError(w, r, errorUnsupportedVersion)
+		return
+	}
+	// Browsers do not send credentials with a preflight, so it is
+	// answered before any middleware that authenticates requests.
+	if r.Method == "OPTIONS" {
+		s.preflight(w, r)
+		return
+	}
+	if s.handshakeLimiter != nil && len(r.FormValue(paramSessionID)) == 0 &&
+		!s.handshakeLimiter.allow(s.remoteIP(r)) {
+		s.logger.Warningf("handshake rate limit exceeded by %s", s.remoteAddr(r))
+		http.Error(w, "too many handshakes", http.StatusTooManyRequests)
 		return
 	}
 
-	if transport == transportWebSocket {
+	s.handler.ServeHTTP(w, r)
+}
+
+// serveTransport passes the request to the handler for its transport.
+func (s *server) serveTransport(w http.ResponseWriter, r *http.Request) {
+	if len(r.FormValue(paramSessionID)) == 0 && s.isDraining() {
+		// Ask the client to retry, so that it reconnects elsewhere.
+		s.setPollingHeaders(w, r)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server is draining", http.StatusServiceUnavailable)
+		return
+	}
+	switch transportParam(r) {
+	case transportWebSocket:
+		// Reject an upgrade of an unknown session with an HTTP error,
+		// which clients can interpret, rather than opening a WebSocket.
+		// The same goes for a rejected handshake.
+		if id := r.FormValue(paramSessionID); len(id) > 0 && s.clients.get(id) == nil {
+			s.logUnknownSession(id)
+			s.serverError(w, r, errorUnknownSID)
+			return
+		} else if len(id) == 0 {
+			if err := s.authenticate(r); err != nil {
+				s.logger.Warningf("websocket handshake rejected: %v", err)
+				s.serverError(w, r, rejectionCode(err))
+				return
+			}
+		}
 		s.wsServer.ServeHTTP(w, r)
-	} else if transport == transportPolling {
+	case transportPolling:
 		s.pollingHandler(w, r)
 	}
 }
 
-// handshakeData returns the JSON encoded data needed
-// for the initial connection handshake.
-func handshakeData(c *conn) ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
-		"pingInterval": 25000,
-		"pingTimeout":  60000,
-		"upgrades":     getValidUpgrades(),
+// Use adds mw to the middleware that handles each request before it is
+// passed to its transport. Middleware runs in the order it was added
+// and may respond to a request itself, for instance to reject it,
+// instead of calling the next handler. It runs for every request,
+// including the polling requests and WebSocket upgrades of existing
+// sessions; a handshake is a request without a sid parameter.
+//
+// Use must not be called once the server has started serving requests.
+func (s *server) Use(mw func(http.Handler) http.Handler) {
+	s.middleware = append(s.middleware, mw)
+	s.handler = http.HandlerFunc(s.serveTransport)
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		s.handler = s.middleware[i](s.handler)
+	}
+}
+
+// authenticate returns the error from the server’s Authenticate
+// option for the handshake request r, if any.
+func (s *server) authenticate(r *http.Request) error {
+	if s.authenticateFunc == nil {
+		return nil
+	}
+	return s.authenticateFunc(r)
+}
+
+// openPacket returns the open packet that begins the connection c,
+// opened by the handshake request r, on either transport.
+func (s *server) openPacket(c *conn, r *http.Request) packet {
+	b, err := s.handshakeData(c, r)
+	if err != nil {
+		c.errorf("could not get handshake data: %v", err)
+	}
+	return packet{typ: packetTypeOpen, data: b}
+}
+
+// transportParam returns the transport requested by r, ignoring case
+// and surrounding whitespace, which some older clients send.
+func transportParam(r *http.Request) string {
+	return strings.ToLower(strings.TrimSpace(r.FormValue(paramTransport)))
+}
+
+// supportsProtocol reports whether the protocol version given by the
+// EIO parameter of r, if any, matches the ProtocolVersion option.
+func (s *server) supportsProtocol(r *http.Request) bool {
+	v := r.FormValue(paramProtocol)
+	return s.protocolVersion == 0 || len(v) == 0 || v == strconv.Itoa(s.protocolVersion)
+}
+
+// handshakeData returns the JSON-encoded handshake sent to the client
+// of c in its open packet. Clients of protocol version 4 and later,
+// as given by the request’s EIO parameter, are also told the largest
+// payload the server accepts. Any fields returned by the
+// HandshakeExtras option that the server does not set are added.
+func (s *server) handshakeData(c *conn, r *http.Request) ([]byte, error) {
+	data := map[string]interface{}{
+		"pingInterval": int64(s.pingInterval / time.Millisecond),
+		"pingTimeout":  int64(s.pingTimeout / time.Millisecond),
+		"upgrades":     s.getValidUpgrades(),
 		"sid":          c.id,
-	})
+	}
+	if v, err := strconv.Atoi(r.FormValue(paramProtocol)); err == nil && v >= 4 {
+		data["maxPayload"] = s.maxPayloadSize
+	}
+	if s.handshakeExtras != nil {
+		for k, v := range s.handshakeExtras(r) {
+			if _, reserved := data[k]; reserved {
+				c.warningf("handshake extra %q conflicts with a reserved field", k)
+				continue
+			}
+			data[k] = v
+		}
+	}
+	return json.Marshal(data)
+}
+
+// An ErrorCode is an error that, returned by the Authenticate option,
+// rejects a handshake with that code. Codes of the application’s own
+// are best chosen from 1000 upwards, with messages set by the
+// ErrorMessages option.
+type ErrorCode int
+
+func (e ErrorCode) Error() string {
+	return "error code " + strconv.Itoa(int(e))
 }
 
-// serverError sends a JSON-encoded message to the given io.Writer
-// with the given error code.
-func serverError(w io.Writer, code int) {
-	if rw, ok := w.(http.ResponseWriter); ok {
-		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusBadRequest)
+// rejectionCode returns the error code with which to reject a handshake
+// that failed authentication with err.
+func rejectionCode(err error) int {
+	var code ErrorCode
+	if errors.As(err, &code) {
+		return int(code)
 	}
+	return errorBadRequest
+}
+
+// WriteError responds to r with the given error code in the same form
+// as the server’s own errors, so that middleware added with Use can
+// reject requests in a way clients understand.
+func (s *server) WriteError(w http.ResponseWriter, r *http.Request, code int) {
+	s.serverError(w, r, code)
+}
+
+// serverError responds to r with a 400 Bad Request and a JSON body
+// holding the given error code and its message, which is how
+// engine.io clients expect errors to be reported. CORS headers are set
+// so that browsers let cross-origin clients read the error.
+func (s *server) serverError(w http.ResponseWriter, r *http.Request, code int) {
+	s.setPollingHeaders(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
 	msg := struct {
 		Code    int    `json:"code"`
 		Message string `json:"message"`
 	}{
 		Code:    code,
-		Message: errorMessage[code],
+		Message: s.errorMessages[code],
 	}
 	if err := json.NewEncoder(w).Encode(msg); err != nil {
-		glog.Errorln("error encoding error msg %+v: %s", msg, err)
+		s.logger.Errorf("error encoding error msg %+v: %s", msg, err)
 		return
 	}
-	glog.Errorf("wrote server error: %+v", msg)
+	s.logger.Errorf("wrote server error: %+v", msg)
+}
+
+// parseCIDR parses s as a CIDR block or, failing that, as a single IP
+// address. It returns nil if s is neither.
+func parseCIDR(s string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+}
+
+// isTrustedProxy reports whether addr, an IP address with or without
+// a port, belongs to one of the TrustedProxies.
+func (s *server) isTrustedProxy(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded reports whether r came from a trusted proxy, so that the
+// X-Forwarded headers it carries can be believed.
+func (s *server) forwarded(r *http.Request) bool {
+	return len(s.trustedProxies) > 0 && s.isTrustedProxy(r.RemoteAddr)
+}
+
+// forwardedProto returns the X-Forwarded-Proto header of r if it came
+// from a trusted proxy.
+func (s *server) forwardedProto(r *http.Request) string {
+	if !s.forwarded(r) {
+		return ""
+	}
+	return r.Header.Get("X-Forwarded-Proto")
+}
+
+// remoteAddr returns the address of the client that made r, preferring
+// the X-Forwarded-For header if r came from a trusted proxy.
+func (s *server) remoteAddr(r *http.Request) string {
+	if addr := r.Header.Get("X-Forwarded-For"); len(addr) > 0 && s.forwarded(r) {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// remoteIP returns the IP address of the client that made r, with the
+// port dropped. If r came from a trusted proxy, it is the last address
+// in X-Forwarded-For that is not itself a trusted proxy, since each
+// proxy appends the address it received the request from and any
+// earlier entries may have been forged by the client.
+func (s *server) remoteIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if s.forwarded(r) {
+		hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if len(hop) == 0 {
+				continue
+			}
+			addr = hop
+			if !s.isTrustedProxy(hop) {
+				break
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// preflight responds to a CORS preflight request so that browsers
+// allow cross-origin polling requests.
+func (s *server) preflight(w http.ResponseWriter, r *http.Request) {
+	s.setPollingHeaders(w, r)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	headers := r.Header.Get("Access-Control-Request-Headers")
+	if len(headers) == 0 {
+		headers = "Content-Type"
+	}
+	w.Header().Set("Access-Control-Allow-Headers", headers)
+	if s.corsMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.FormatInt(int64(s.corsMaxAge/time.Second), 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // setPollingHeaders sets the appropriate headers when responding
 // to an XHR polling request.
-func setPollingHeaders(w http.ResponseWriter, r *http.Request) {
+func (s *server) setPollingHeaders(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
 	if len(origin) > 0 {
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
@@ -369,6 +1498,15 @@ func setPollingHeaders(w http.ResponseWriter, r *http.Request) {
 		origin = "*"
 	}
 	w.Header().Set("Access-Control-Allow-Origin", origin)
-	w.Header().Set("Connection", "keep-alive")
+	if r.ProtoMajor == 1 {
+		// Connection is a hop-by-hop header that is not allowed in HTTP/2.
+		w.Header().Set("Connection", "keep-alive")
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	for k, v := range s.responseHeaders {
+		w.Header().Del(k)
+		for _, vv := range v {
+			w.Header().Add(k, vv)
+		}
+	}
 }
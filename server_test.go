@@ -6,26 +6,51 @@
 package ftc
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"code.google.com/p/go.net/websocket"
 )
 
 var echoHandler = Handler(func(c *Conn) { io.Copy(c, c) })
 
+// connHandler returns a handler that sends each connection to conns
+// and keeps it open until it is closed.
+func connHandler(conns chan<- *Conn) Handler {
+	return func(c *Conn) {
+		conns <- c
+		<-c.Done()
+	}
+}
+
 func TestTransportParam(t *testing.T) {
 	ts := httptest.NewServer(NewServer(nil, nil))
 	defer ts.Close()
 	testCases := map[string]int{
-		defaultBasePath + "?transport=hyperloop": 400,
-		defaultBasePath + "?transport=polling":   200,
+		defaultBasePath + "?transport=hyperloop":   400,
+		defaultBasePath + "?transport=polling":     200,
+		defaultBasePath + "?transport=Polling":     200,
+		defaultBasePath + "?transport=+POLLING%20": 200,
+		defaultBasePath + "?transport=":            400,
 	}
 	for path, statusCode := range testCases {
 		resp, err := http.Get(ts.URL + path)
@@ -38,7 +63,95 @@ func TestTransportParam(t *testing.T) {
 		resp.Body.Close()
 	}
 	serverAddr := ts.Listener.Addr().String()
-	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", ts.URL)
+	for _, transport := range []string{"websocket", "WebSocket", "WEBSOCKET"} {
+		ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport="+transport, "", ts.URL)
+		if err != nil {
+			t.Fatalf("%s: websocket dial error: %v", transport, err)
+		}
+		ws.Close()
+	}
+}
+
+func TestProtocolVersion(t *testing.T) {
+	ts := httptest.NewServer(NewServer(&Options{ProtocolVersion: 3}, nil))
+	defer ts.Close()
+	for query, code := range map[string]int{
+		"":       -1,
+		"&EIO=3": -1,
+		"&EIO=4": errorUnsupportedVersion,
+		"&EIO=x": errorUnsupportedVersion,
+	} {
+		resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling" + query)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		var msg struct {
+			Code int `json:"code"`
+		}
+		if code < 0 {
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%q: expected status %d, got %d", query, http.StatusOK, resp.StatusCode)
+			}
+		} else if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil || msg.Code != code {
+			t.Errorf("%q: expected error code %d, got %d (%v)", query, code, msg.Code, err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/ws/", http.StripPrefix("/ws", NewServer(nil, nil)))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	testCases := map[string]int{
+		"/ws/?transport=hyperloop": 400,
+		"/ws/?transport=polling":   200,
+		"/ws/?transport=":          400,
+	}
+	for path, statusCode := range testCases {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != statusCode {
+			t.Errorf("%s: got status code %d. expected %d.", path, resp.StatusCode, statusCode)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestMultipleMountPoints(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	mux := http.NewServeMux()
+	mux.Handle(defaultBasePath, ftcServer)
+	mux.Handle("/ws/", ftcServer)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	defer ftcServer.Shutdown()
+	for _, path := range []string{defaultBasePath, "/ws/"} {
+		resp, err := http.Get(ts.URL + path + "?transport=hyperloop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status code %d, got %d", path, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+	// A session opened under one prefix may be used under the other.
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	if _, err := c.WriteString("hello"); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	msgs := pollMessages(ts.URL+"/ws/?transport=polling&sid="+sid, t)
+	if len(msgs) != 1 || string(msgs[0]) != "hello" {
+		t.Errorf("expected message %q, got %q", "hello", msgs)
+	}
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+"/ws/?transport=websocket", "", ts.URL)
 	if err != nil {
 		t.Fatalf("websocket dial error: %v", err)
 	}
@@ -196,3 +309,2793 @@ func TestWebSockets(t *testing.T) {
 		t.Errorf("original and returned packets don’t match. returned packet: %+v", pkt)
 	}
 }
+
+func TestOpenPacketTransports(t *testing.T) {
+	ts := httptest.NewServer(NewServer(&Options{
+		HandshakeExtras: func(r *http.Request) map[string]interface{} {
+			return map[string]interface{}{"region": "us-east"}
+		},
+	}, nil))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var payload []packet
+	err = newPayloadDecoder(resp.Body).decode(&payload)
+	resp.Body.Close()
+	if err != nil || len(payload) != 1 || payload[0].typ != packetTypeOpen {
+		t.Fatalf("expected an open packet over polling, got %+v (%v)", payload, err)
+	}
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil || pkt.typ != packetTypeOpen {
+		t.Fatalf("expected an open packet over websocket, got %+v (%v)", pkt, err)
+	}
+	// Apart from the session ID, the handshakes are byte-identical.
+	sid := func(b []byte) []byte {
+		var hs struct {
+			SID string `json:"sid"`
+		}
+		if err := json.Unmarshal(b, &hs); err != nil {
+			t.Fatalf("json unmarshal error: %v", err)
+		}
+		return []byte(hs.SID)
+	}
+	polling := payload[0].data
+	fromWS := bytes.Replace(pkt.data, sid(pkt.data), sid(polling), 1)
+	if !bytes.Equal(polling, fromWS) {
+		t.Errorf("expected matching handshakes, got %s over polling and %s over websocket", polling, pkt.data)
+	}
+}
+
+func TestWebSocketImmediateMessage(t *testing.T) {
+	// A short ping interval would let a ping overtake the open packet
+	// if the heartbeat started before it was sent.
+	ftcServer := NewServer(&Options{PingInterval: time.Millisecond}, echoHandler)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	for i := 0; i < 20; i++ {
+		ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+		if err != nil {
+			t.Fatalf("websocket dial error: %v", err)
+		}
+		// Send a message without waiting for the open packet.
+		sent := []byte("hello " + strconv.Itoa(i))
+		if err := newPacketEncoder(ws).encode(packet{typ: packetTypeMessage, data: sent}); err != nil {
+			t.Fatalf("could not send message: %v", err)
+		}
+		dec := newPacketDecoder(ws)
+		var pkt packet
+		if err := dec.decode(&pkt); err != nil {
+			t.Fatalf("could not decode packet: %v", err)
+		}
+		if pkt.typ != packetTypeOpen {
+			t.Fatalf("expected the first packet to be open, got %+v", pkt)
+		}
+		for pkt.typ != packetTypeMessage {
+			if err := dec.decode(&pkt); err != nil {
+				t.Fatalf("could not decode packet: %v", err)
+			}
+		}
+		if !bytes.Equal(pkt.data, sent) {
+			t.Errorf("expected echo of %q, got %q", sent, pkt.data)
+		}
+		ws.Close()
+	}
+}
+
+func TestBinaryFrames(t *testing.T) {
+	type frame struct {
+		msg    string
+		binary bool
+	}
+	frames := make(chan frame, 2)
+	ftcServer := NewServer(nil, func(c *Conn) {
+		for {
+			msg, binary, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			frames <- frame{string(msg), binary}
+		}
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	// A binary frame holds the message alone, with no packet type.
+	if err := websocket.Message.Send(ws, []byte{0, 1, 0xff}); err != nil {
+		t.Fatalf("could not send binary frame: %v", err)
+	}
+	if err := websocket.Message.Send(ws, "4text"); err != nil {
+		t.Fatalf("could not send text frame: %v", err)
+	}
+	for _, expected := range []frame{{"\x00\x01\xff", true}, {"text", false}} {
+		select {
+		case f := <-frames:
+			if f != expected {
+				t.Errorf("expected %+v, got %+v", expected, f)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", expected)
+		}
+	}
+}
+
+func TestConcurrentHandshakes(t *testing.T) {
+	const n = 500
+	// A short reap interval keeps the reaper sweeping the client set
+	// while it is being added to.
+	ftcServer := NewServer(&Options{ReapInterval: time.Millisecond}, connHandler(make(chan *Conn, n)))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	defer ftcServer.Shutdown()
+	sids := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling")
+			if err != nil {
+				t.Errorf("http get error: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			var payload []packet
+			if err := newPayloadDecoder(resp.Body).decode(&payload); err != nil || len(payload) != 1 {
+				t.Errorf("could not decode open payload (%d packets): %v", len(payload), err)
+				return
+			}
+			var hs struct{ SID string }
+			if err := json.Unmarshal(payload[0].data, &hs); err != nil {
+				t.Errorf("json unmarshal error: %v", err)
+				return
+			}
+			sids <- hs.SID
+		}()
+	}
+	wg.Wait()
+	close(sids)
+	seen := map[string]bool{}
+	for sid := range sids {
+		if seen[sid] {
+			t.Errorf("session ID %q was handed out twice", sid)
+		}
+		seen[sid] = true
+		if c := ftcServer.clients.get(sid); c == nil || c.isClosed() {
+			t.Errorf("expected session %q to be open", sid)
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("expected %d sessions, got %d", n, len(seen))
+	}
+	if l := ftcServer.clients.len(); l != n {
+		t.Errorf("expected %d connections in the client set, got %d", n, l)
+	}
+}
+
+func TestConcurrentWebSocketWrites(t *testing.T) {
+	ftcServer := NewServer(nil, echoHandler)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	if pkt.typ != packetTypeOpen {
+		t.Fatalf("expected packet type to be open (0), got %q", pkt.typ)
+	}
+	// Large messages would be split across frames if writes were not
+	// encoded and written as a single unit.
+	const n = 50
+	msg := bytes.Repeat([]byte("Foo 世 bar baz 界 qux"), 512)
+	go func() {
+		enc := newPacketEncoder(ws)
+		for i := 0; i < n; i++ {
+			if err := enc.encode(packet{typ: packetTypePing, data: []byte("probe")}); err != nil {
+				t.Errorf("unable to send ping: %v", err)
+				return
+			}
+			if err := enc.encode(packet{typ: packetTypeMessage, data: msg}); err != nil {
+				t.Errorf("unable to send message: %v", err)
+				return
+			}
+		}
+	}()
+	var pongs, msgs int
+	for i := 0; i < 2*n; i++ {
+		if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+			t.Fatalf("error decoding websocket packet: %v", err)
+		}
+		switch {
+		case pkt.typ == packetTypePong && string(pkt.data) == "probe":
+			pongs++
+		case pkt.typ == packetTypeMessage && bytes.Equal(pkt.data, msg):
+			msgs++
+		default:
+			t.Fatalf("unexpected or corrupted packet type %q with %d bytes of data", pkt.typ, len(pkt.data))
+		}
+	}
+	if pongs != n || msgs != n {
+		t.Errorf("expected %d pongs and %d messages, got %d and %d", n, n, pongs, msgs)
+	}
+}
+
+// pollMessages performs a polling GET and returns the data of any
+// message packets in the response payload.
+func pollMessages(addr string, t *testing.T) [][]byte {
+	resp, err := http.Get(addr)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	defer resp.Body.Close()
+	var payload []packet
+	if err := newPayloadDecoder(resp.Body).decode(&payload); err != nil {
+		t.Fatalf("could not decode response body: %v", err)
+	}
+	var msgs [][]byte
+	for _, pkt := range payload {
+		if pkt.typ == packetTypeMessage {
+			msgs = append(msgs, pkt.data)
+		}
+	}
+	return msgs
+}
+
+// probeWebSocket opens a WebSocket to upgrade the polling connection
+// with the given session ID and performs the probe that begins the
+// upgrade: the client sends a ping with the data "probe", which the
+// server answers with a matching pong.
+func probeWebSocket(ts *httptest.Server, sid string, t *testing.T) *websocket.Conn {
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket&sid="+sid, "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	if err := newPacketEncoder(ws).encode(packet{typ: packetTypePing, data: []byte("probe")}); err != nil {
+		t.Fatalf("could not send probe: %v", err)
+	}
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode probe response: %v", err)
+	}
+	if pkt.typ != packetTypePong || string(pkt.data) != "probe" {
+		t.Fatalf("expected pong probe, got %+v", pkt)
+	}
+	return ws
+}
+
+// upgradePolling performs a polling handshake and then the full upgrade
+// of the connection to a WebSocket, verifying each step:
+//
+//  1. The client handshakes over polling and receives an open packet.
+//  2. It opens a WebSocket and sends a "probe" ping, answered by a pong.
+//  3. The server queues a noop so that any in-flight poll returns and
+//     the client can stop polling; the next poll receives it.
+//  4. The client sends an upgrade packet over the WebSocket, after
+//     which the server uses it as the connection’s transport.
+//
+// It returns the session ID and the upgraded WebSocket.
+func upgradePolling(ts *httptest.Server, s *server, t *testing.T) (string, *websocket.Conn) {
+	sid := handshakePolling(ts.URL, s, t)
+	ws := probeWebSocket(ts, sid, t)
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling&sid=" + sid)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var payload []packet
+	err = newPayloadDecoder(resp.Body).decode(&payload)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not decode response body: %v", err)
+	}
+	if len(payload) == 0 || payload[len(payload)-1].typ != packetTypeNoop {
+		t.Fatalf("expected the poll to end with a noop packet, got %+v", payload)
+	}
+	if err := newPacketEncoder(ws).encode(packet{typ: packetTypeUpgrade}); err != nil {
+		t.Fatalf("could not send upgrade: %v", err)
+	}
+	c := s.clients.get(sid)
+	if c == nil {
+		t.Fatal("connection not found after upgrade")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.upgraded() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not upgraded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return sid, ws
+}
+
+func TestUpgrade(t *testing.T) {
+	ftcServer := NewServer(nil, echoHandler)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	_, ws := upgradePolling(ts, ftcServer, t)
+	defer ws.Close()
+	msg := []byte("Foo 世 bar baz 界 qux")
+	if err := newPacketEncoder(ws).encode(packet{typ: packetTypeMessage, data: msg}); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	if pkt.typ != packetTypeMessage || !bytes.Equal(pkt.data, msg) {
+		t.Errorf("expected echo of %q over the websocket, got %+v", msg, pkt)
+	}
+}
+
+func TestUpgradeDeliversOnce(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	var expected [][]byte
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			msg := []byte(strconv.Itoa(len(expected)))
+			if _, err := c.Write(msg); err != nil {
+				t.Fatalf("could not write message: %v", err)
+			}
+			expected = append(expected, msg)
+		}
+	}
+	write(5)
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	received := pollMessages(addr, t)
+
+	ws := probeWebSocket(ts, sid, t)
+	defer ws.Close()
+	var pkt packet
+	// A GET racing the upgrade receives whatever is still buffered.
+	received = append(received, pollMessages(addr, t)...)
+	write(5)
+	if err := newPacketEncoder(ws).encode(packet{typ: packetTypeUpgrade}); err != nil {
+		t.Fatalf("could not send upgrade: %v", err)
+	}
+	for !c.c.upgraded() {
+		time.Sleep(time.Millisecond)
+	}
+	// Polls after the upgrade must not deliver messages.
+	if msgs := pollMessages(addr, t); len(msgs) > 0 {
+		t.Errorf("expected no messages over polling after upgrade, got %q", msgs)
+	}
+	write(5)
+	for len(received) < len(expected) {
+		if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+			t.Fatalf("could not decode packet: %v", err)
+		}
+		if pkt.typ == packetTypeMessage {
+			received = append(received, pkt.data)
+		}
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected messages %q exactly once in order, got %q", expected, received)
+	}
+}
+
+func TestUpgradeOrdering(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	const n = 500
+	for iter := 0; iter < 5; iter++ {
+		sid := handshakePolling(ts.URL, ftcServer, t)
+		c := <-conns
+		// Write continuously while the client polls and upgrades,
+		// retrying messages that the full send queue turned away.
+		errc := make(chan error, 1)
+		go func() {
+			for i := 0; i < n; i++ {
+				for {
+					_, err := c.WriteString(strconv.Itoa(i))
+					if err == ErrBackpressure {
+						time.Sleep(100 * time.Microsecond)
+						continue
+					}
+					if err != nil {
+						errc <- err
+						return
+					}
+					break
+				}
+			}
+			errc <- nil
+		}()
+		addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+		var received [][]byte
+		for i := 0; i < 3; i++ {
+			received = append(received, pollMessages(addr, t)...)
+		}
+		ws := probeWebSocket(ts, sid, t)
+		// The poll that completes the polling cycle, after which the
+		// client sends the upgrade.
+		received = append(received, pollMessages(addr, t)...)
+		if err := newPacketEncoder(ws).encode(packet{typ: packetTypeUpgrade}); err != nil {
+			t.Fatalf("could not send upgrade: %v", err)
+		}
+		dec := newPacketDecoder(ws)
+		for len(received) < n {
+			var pkt packet
+			if err := dec.decode(&pkt); err != nil {
+				t.Fatalf("could not decode packet after %d messages: %v", len(received), err)
+			}
+			if pkt.typ == packetTypeMessage {
+				received = append(received, pkt.data)
+			}
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+		for i, msg := range received {
+			if string(msg) != strconv.Itoa(i) {
+				t.Fatalf("expected message %d, got %q", i, msg)
+			}
+		}
+		ws.Close()
+	}
+}
+
+func TestWriteBatchWebSocket(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	_, ws := upgradePolling(ts, ftcServer, t)
+	defer ws.Close()
+	c := <-conns
+	// Batches written concurrently arrive whole.
+	const writers, batches = 4, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := strconv.Itoa(w)
+			for i := 0; i < batches; i++ {
+				if err := c.WriteBatch([][]byte{[]byte(id + "a"), []byte(id + "b"), []byte(id + "c")}); err != nil {
+					t.Errorf("could not write batch: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	dec := newPacketDecoder(ws)
+	var received []string
+	for len(received) < writers*batches*3 {
+		var pkt packet
+		if err := dec.decode(&pkt); err != nil {
+			t.Fatalf("could not decode packet: %v", err)
+		}
+		if pkt.typ == packetTypeMessage {
+			received = append(received, string(pkt.data))
+		}
+	}
+	wg.Wait()
+	for i := 0; i < len(received); i += 3 {
+		id := received[i][:1]
+		if received[i] != id+"a" || received[i+1] != id+"b" || received[i+2] != id+"c" {
+			t.Fatalf("expected a whole batch at %d, got %q", i, received[i:i+3])
+		}
+	}
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{UpgradeTimeout: 50 * time.Millisecond}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	ws := probeWebSocket(ts, sid, t)
+	defer ws.Close()
+	var pkt packet
+	// The upgrade packet is never sent, so the server should close the
+	// WebSocket once the timeout elapses.
+	if err := newPacketDecoder(ws).decode(&pkt); err == nil {
+		t.Fatalf("expected websocket to be closed, got packet %+v", pkt)
+	}
+	if c.c.upgraded() {
+		t.Error("expected connection not to be upgraded")
+	}
+	if c.c.isClosed() {
+		t.Fatal("expected connection to remain open over polling")
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	var msgs [][]byte
+	for len(msgs) == 0 {
+		msgs = pollMessages(addr, t)
+	}
+	if len(msgs) != 1 || string(msgs[0]) != "hello" {
+		t.Errorf("expected message %q over polling, got %q", "hello", msgs)
+	}
+}
+
+func TestUpgradeDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{UpgradeDelay: delay, UpgradeTimeout: 100 * time.Millisecond}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	defer ftcServer.Shutdown()
+	start := time.Now()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	probed := make(chan *websocket.Conn, 1)
+	go func() {
+		serverAddr := ts.Listener.Addr().String()
+		ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket&sid="+sid, "", "http://"+serverAddr)
+		if err != nil {
+			t.Errorf("websocket dial error: %v", err)
+			close(probed)
+			return
+		}
+		if err := newPacketEncoder(ws).encode(packet{typ: packetTypePing, data: []byte("probe")}); err != nil {
+			t.Errorf("could not send probe: %v", err)
+		}
+		var pkt packet
+		if err := newPacketDecoder(ws).decode(&pkt); err != nil || pkt.typ != packetTypePong {
+			t.Errorf("expected pong probe, got %+v, %v", pkt, err)
+		}
+		probed <- ws
+	}()
+	// Polling carries on while the probe waits.
+	if _, err := c.WriteString("hello"); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	if msgs := pollMessages(addr, t); len(msgs) != 1 || string(msgs[0]) != "hello" {
+		t.Errorf("expected message %q over polling, got %q", "hello", msgs)
+	}
+	ws := <-probed
+	if ws == nil {
+		t.FailNow()
+	}
+	defer ws.Close()
+	if d := time.Since(start); d < delay {
+		t.Errorf("expected the probe to be answered after %v, took %v", delay, d)
+	}
+	// The upgrade timeout, shorter than the delay, starts afterwards.
+	if err := newPacketEncoder(ws).encode(packet{typ: packetTypeUpgrade}); err != nil {
+		t.Fatalf("could not send upgrade: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !c.Upgraded() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected connection to be upgraded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{HandshakeTimeout: 50 * time.Millisecond}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket&sid="+sid, "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	// The probe is never sent, so the server should close the WebSocket
+	// well before the default UpgradeTimeout.
+	start := time.Now()
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err == nil {
+		t.Fatalf("expected websocket to be closed, got packet %+v", pkt)
+	}
+	if d := time.Since(start); d > defaultUpgradeTimeout/2 {
+		t.Errorf("expected websocket to be closed after the handshake timeout, took %v", d)
+	}
+	if c.c.isClosed() {
+		t.Error("expected connection to remain open over polling")
+	}
+}
+
+func TestMaxPayloadSize(t *testing.T) {
+	ftcServer := NewServer(&Options{MaxPayloadSize: 64}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	// A message of n bytes makes a body of n+4 bytes.
+	testCases := map[int]int{
+		32:  http.StatusOK,
+		60:  http.StatusOK,
+		61:  http.StatusRequestEntityTooLarge,
+		128: http.StatusRequestEntityTooLarge,
+	}
+	for size, statusCode := range testCases {
+		p := []packet{packet{typ: packetTypeMessage, data: bytes.Repeat([]byte("a"), size)}}
+		var buf bytes.Buffer
+		if err := newPayloadEncoder(&buf).encode(p); err != nil {
+			t.Fatalf("could not encode payload: %v", err)
+		}
+		resp, err := http.Post(addr, "text/plain;charset=UTF-8", &buf)
+		if err != nil {
+			t.Fatalf("http post error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != statusCode {
+			t.Errorf("%d byte message: got status code %d. expected %d.", size, resp.StatusCode, statusCode)
+		}
+		// The connection of a request whose body is too large is not
+		// reused, since the rest of the body was not read.
+		if tooLarge := statusCode == http.StatusRequestEntityTooLarge; resp.Close != tooLarge {
+			t.Errorf("%d byte message: expected the connection to be closed: %t", size, tooLarge)
+		}
+	}
+}
+
+func TestReapOnClose(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{ReapInterval: time.Hour}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	if n := ftcServer.clients.len(); n != 1 {
+		t.Fatalf("expected one client, got %d", n)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("problem closing connection: %v", err)
+	}
+	// The conn is kept until a poll has received its close packet.
+	pollMessages(ts.URL+defaultBasePath+"?transport=polling&sid="+sid, t)
+	deadline := time.Now().Add(time.Second)
+	for ftcServer.clients.len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection was not removed from the client set")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	conns := make(chan *Conn, 2)
+	closed := make(chan error, 2)
+	ftcServer := NewServer(&Options{
+		IdleTimeout:  100 * time.Millisecond,
+		ReapInterval: 10 * time.Millisecond,
+		OnClose:      func(c *Conn, err error) { closed <- err },
+	}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	handshakePolling(ts.URL, ftcServer, t)
+	idle := <-conns
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	active := <-conns
+	// Keep the second connection busy while the first one idles.
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		resp, err := http.Post(addr, "text/plain;charset=UTF-8", strings.NewReader("6:4hello"))
+		if err != nil {
+			t.Fatalf("http post error: %v", err)
+		}
+		resp.Body.Close()
+		if _, err := active.ReadMessage(); err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case err := <-closed:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Reason != DisconnectIdle {
+			t.Errorf("expected the connection to be closed as idle, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the idle connection to be closed")
+	}
+	if !idle.Closed() {
+		t.Error("expected the idle connection to be closed")
+	}
+	if active.Closed() {
+		t.Error("expected the active connection to stay open")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	opts := &Options{PingInterval: 20 * time.Millisecond, PingTimeout: 200 * time.Millisecond}
+	ftcServer := NewServer(opts, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	before := numClosesFor(DisconnectPongTimeout)
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	// Answering each ping keeps the connection open.
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(addr)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		var payload []packet
+		err = newPayloadDecoder(resp.Body).decode(&payload)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("could not decode response body: %v", err)
+		}
+		if len(payload) != 1 || payload[0].typ != packetTypePing {
+			t.Fatalf("expected a ping packet, got %+v", payload)
+		}
+		var buf bytes.Buffer
+		if err := newPayloadEncoder(&buf).encode([]packet{packet{typ: packetTypePong}}); err != nil {
+			t.Fatalf("could not encode payload: %v", err)
+		}
+		resp, err = http.Post(addr, "text/plain;charset=UTF-8", &buf)
+		if err != nil {
+			t.Fatalf("http post error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	c.c.mu.RLock()
+	closed := c.c.closed
+	c.c.mu.RUnlock()
+	if closed {
+		t.Fatal("expected connection to stay open while answering pings")
+	}
+	if c.RTT() <= 0 {
+		t.Errorf("expected a positive round-trip time, got %v", c.RTT())
+	}
+	// Once the client stops answering, the connection is closed.
+	select {
+	case <-c.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected connection to be closed after a pong timeout")
+	}
+	if n := numClosesFor(DisconnectPongTimeout) - before; n != 1 {
+		t.Errorf("expected %s counter to increase by 1, increased by %d", DisconnectPongTimeout, n)
+	}
+}
+
+func TestHandlerFunc(t *testing.T) {
+	errBoom := errors.New("boom")
+	testCases := map[string]HandlerFunc{
+		"error": func(c *Conn) error { return errBoom },
+		"panic": func(c *Conn) error { panic(errBoom) },
+	}
+	for name, h := range testCases {
+		closed := make(chan error, 1)
+		opts := &Options{OnClose: func(c *Conn, err error) { closed <- err }}
+		ftcServer := NewServerFunc(opts, h)
+		ts := httptest.NewServer(ftcServer)
+		handshakePolling(ts.URL, ftcServer, t)
+		select {
+		case err := <-closed:
+			if err == nil || !strings.Contains(err.Error(), errBoom.Error()) {
+				t.Errorf("%s: expected OnClose error to contain %q, got %v", name, errBoom, err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: expected connection to be closed", name)
+		}
+		// The server keeps serving other connections.
+		handshakePolling(ts.URL, ftcServer, t)
+		ts.Close()
+	}
+}
+
+func TestHandlerReturns(t *testing.T) {
+	closed := make(chan error, 1)
+	ftcServer := NewServer(&Options{OnClose: func(c *Conn, err error) { closed <- err }}, func(c *Conn) {})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	dec := newPacketDecoder(ws)
+	var pkt packet
+	if err := dec.decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	if err := dec.decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	if pkt.typ != packetTypeClose {
+		t.Errorf("expected packet type to be close (1), got %q", pkt.typ)
+	}
+	select {
+	case err := <-closed:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Reason != DisconnectHandlerReturned {
+			t.Errorf("expected OnClose error with reason %s, got %v", DisconnectHandlerReturned, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be closed once the handler returned")
+	}
+}
+
+func TestPostAfterHandlerReturns(t *testing.T) {
+	closed := make(chan struct{})
+	ftcServer := NewServer(&Options{OnClose: func(c *Conn, err error) { close(closed) }}, func(c *Conn) {})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be closed once the handler returned")
+	}
+	// The conn waits in the client set for its close packet to be
+	// polled, so messages and pings sent meanwhile are dropped.
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	resp, err := http.Post(addr, "text/plain;charset=UTF-8", strings.NewReader("2:4x1:2"))
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "ok" {
+		t.Errorf("expected ok, got %d: %s", resp.StatusCode, b)
+	}
+	resp, err = http.Get(addr)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	defer resp.Body.Close()
+	var payload []packet
+	if err := newPayloadDecoder(resp.Body).decode(&payload); err != nil {
+		t.Fatalf("could not decode payload: %v", err)
+	}
+	if len(payload) != 1 || payload[0].typ != packetTypeClose {
+		t.Errorf("expected only a close packet, got %+v", payload)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	closed := make(chan error, 1)
+	conns := make(chan *Conn, 1)
+	var n int32
+	opts := &Options{OnClose: func(c *Conn, err error) {
+		select {
+		case closed <- err:
+		default:
+		}
+	}}
+	ftcServer := NewServer(opts, func(c *Conn) {
+		if atomic.AddInt32(&n, 1) == 2 {
+			panic("boom")
+		}
+		conns <- c
+		<-c.Done()
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	defer ftcServer.Shutdown()
+	handshakePolling(ts.URL, ftcServer, t)
+	other := <-conns
+	handshakePolling(ts.URL, ftcServer, t)
+	select {
+	case err := <-closed:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Reason != DisconnectHandlerError ||
+			!strings.Contains(err.Error(), "boom") {
+			t.Errorf("expected a handler error containing %q, got %v", "boom", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the panicking connection to be closed")
+	}
+	// The other connection and the server are unaffected.
+	if other.Closed() {
+		t.Error("expected the other connection to stay open")
+	}
+	handshakePolling(ts.URL, ftcServer, t)
+	if c := <-conns; c.Closed() {
+		t.Error("expected a new connection to be served")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	value := func(name string) int64 {
+		return expvar.Get(name).(*expvar.Int).Value()
+	}
+	names := []string{
+		"num_handshakes", "num_upgrades", "num_upgrade_failures",
+		"num_messages_in", "num_messages_out", "num_bytes_in", "num_bytes_out",
+	}
+	before := map[string]int64{}
+	for _, name := range names {
+		before[name] = value(name)
+	}
+	byTransport := expvar.Get("num_clients_by_transport").(*expvar.Map)
+	clients := func(transport string) int64 {
+		if v, ok := byTransport.Get(transport).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	pollingBefore, wsBefore := clients(transportPolling), clients(transportWebSocket)
+	ftcServer := NewServer(nil, echoHandler)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	// One connection fails to upgrade and another upgrades and echoes
+	// a message.
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	probeWebSocket(ts, sid, t).Close()
+	_, ws := upgradePolling(ts, ftcServer, t)
+	defer ws.Close()
+	if err := newPacketEncoder(ws).encode(packet{typ: packetTypeMessage, data: []byte("hello")}); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	expected := map[string]int64{
+		"num_handshakes":       2,
+		"num_upgrades":         1,
+		"num_upgrade_failures": 1,
+		"num_messages_in":      1,
+		"num_messages_out":     1,
+		"num_bytes_in":         5,
+		"num_bytes_out":        5,
+	}
+	deadline := time.Now().Add(time.Second)
+	for _, name := range names {
+		// The failed upgrade is counted once the server notices.
+		for value(name)-before[name] < expected[name] && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := value(name) - before[name]; n != expected[name] {
+			t.Errorf("%s: expected an increase of %d, got %d", name, expected[name], n)
+		}
+	}
+	if n := clients(transportPolling) - pollingBefore; n != 1 {
+		t.Errorf("expected 1 more polling connection, got %d", n)
+	}
+	if n := clients(transportWebSocket) - wsBefore; n != 1 {
+		t.Errorf("expected 1 more websocket connection, got %d", n)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	ftcServer := NewServer(nil, nil)
+	conns := make([]*conn, 3)
+	for i := range conns {
+		c, err := ftcServer.newConn(httptest.NewRequest("GET", "/", nil), nil)
+		if err != nil {
+			t.Fatalf("could not create connection: %v", err)
+		}
+		conns[i] = c
+	}
+	conns[2].Close()
+	seen := map[*Conn]bool{}
+	ftcServer.ForEach(func(c *Conn) bool {
+		seen[c] = true
+		return true
+	})
+	if len(seen) != 2 || !seen[conns[0].pubConn] || !seen[conns[1].pubConn] {
+		t.Errorf("expected only the open connections to be visited, got %d", len(seen))
+	}
+	n := 0
+	ftcServer.ForEach(func(c *Conn) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("expected iteration to stop after the first connection, visited %d", n)
+	}
+	for _, c := range conns[:2] {
+		c.Close()
+	}
+}
+
+func TestWebSocketCloseCode(t *testing.T) {
+	closed := make(chan error, 1)
+	ftcServer := NewServer(&Options{OnClose: func(c *Conn, err error) { closed <- err }}, echoHandler)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	// Closing the WebSocket sends a close frame rather than a close packet.
+	ws.Close()
+	select {
+	case err := <-closed:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Reason != DisconnectTransportError || closeErr.Code != CloseNormalClosure {
+			t.Errorf("expected OnClose error with reason %s and code %d, got %+v", DisconnectTransportError, CloseNormalClosure, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be closed")
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	closed := make(chan error, 1)
+	ftcServer := NewServer(&Options{OnClose: func(c *Conn, err error) { closed <- err }}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(pkt.data, &m); err != nil {
+		t.Fatalf("json unmarshal error: %v", err)
+	}
+	sid := m["sid"].(string)
+	if ftcServer.Disconnect("unknown") {
+		t.Error("expected disconnecting an unknown session ID to return false")
+	}
+	if !ftcServer.Disconnect(sid) {
+		t.Fatalf("expected session %s to be disconnected", sid)
+	}
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	if pkt.typ != packetTypeClose {
+		t.Errorf("expected packet type to be close (1), got %q", pkt.typ)
+	}
+	err = <-closed
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Reason != DisconnectKicked || !errors.Is(err, ErrKicked) {
+		t.Errorf("expected OnClose error with reason %s and cause %v, got %v", DisconnectKicked, ErrKicked, err)
+	}
+	if ftcServer.Disconnect(sid) {
+		t.Error("expected disconnecting a closed session to return false")
+	}
+}
+
+func TestDisconnectWhere(t *testing.T) {
+	var mu sync.Mutex
+	closed := map[*Conn]error{}
+	ftcServer := NewServer(&Options{OnClose: func(c *Conn, err error) {
+		mu.Lock()
+		closed[c] = err
+		mu.Unlock()
+	}}, nil)
+	conns := make([]*conn, 4)
+	for i := range conns {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", "banned")
+		if i%2 == 1 {
+			r.Header.Set("User-Agent", "allowed")
+		}
+		c, err := ftcServer.newConn(r, nil)
+		if err != nil {
+			t.Fatalf("could not create connection: %v", err)
+		}
+		conns[i] = c
+	}
+	defer ftcServer.Shutdown()
+	// A connection that is already closed is not counted.
+	conns[2].Close()
+	n := ftcServer.DisconnectWhere(func(c *Conn) bool {
+		// The client set is not locked while the predicate runs.
+		ftcServer.ForEach(func(*Conn) bool { return false })
+		return c.UserAgent() == "banned"
+	})
+	if n != 1 {
+		t.Errorf("expected 1 connection to be disconnected, got %d", n)
+	}
+	for i, c := range conns {
+		if want := i%2 == 0; c.isClosed() != want {
+			t.Errorf("connection %d: expected closed to be %v", i, want)
+		}
+	}
+	mu.Lock()
+	err := closed[conns[0].pubConn]
+	mu.Unlock()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Reason != DisconnectKicked || !errors.Is(err, ErrKicked) {
+		t.Errorf("expected OnClose error with reason %s and cause %v, got %v", DisconnectKicked, ErrKicked, err)
+	}
+	if n := ftcServer.DisconnectWhere(func(*Conn) bool { return true }); n != 2 {
+		t.Errorf("expected the 2 remaining connections to be disconnected, got %d", n)
+	}
+}
+
+func TestPollingHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(NewServer(nil, echoHandler))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	client := ts.Client()
+	resp, err := client.Get(ts.URL + defaultBasePath + "?transport=polling")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected an HTTP/2 response, got %s", resp.Proto)
+	}
+	if v := resp.Header.Get("Connection"); len(v) > 0 {
+		t.Errorf("expected no Connection header over HTTP/2, got %q", v)
+	}
+	var payload []packet
+	if err := newPayloadDecoder(resp.Body).decode(&payload); err != nil {
+		t.Fatalf("could not decode payload from response body: %v", err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(payload[0].data, &m); err != nil {
+		t.Fatalf("json unmarshal error: %v", err)
+	}
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + m["sid"].(string)
+	var buf bytes.Buffer
+	sent := []packet{packet{typ: packetTypeMessage, data: []byte("hello")}}
+	if err := newPayloadEncoder(&buf).encode(sent); err != nil {
+		t.Fatalf("could not encode payload: %v", err)
+	}
+	postResp, err := client.Post(addr, "text/plain; charset=UTF-8", &buf)
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	postResp.Body.Close()
+	getResp, err := client.Get(addr)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	defer getResp.Body.Close()
+	if err := newPayloadDecoder(getResp.Body).decode(&payload); err != nil {
+		t.Fatalf("could not decode payload from response body: %v", err)
+	}
+	if len(payload) != 1 || payload[0].typ != packetTypeMessage || string(payload[0].data) != "hello" {
+		t.Errorf("expected echo of %q, got %+v", "hello", payload)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{SendQueueSize: 2}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	for i := 0; i < 2; i++ {
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatalf("could not write message %d: %v", i, err)
+		}
+	}
+	if _, err := c.Write([]byte("hello")); err != ErrBackpressure {
+		t.Fatalf("expected error %v, got %v", ErrBackpressure, err)
+	}
+	// A ping is still answered while the queue is full.
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	resp, err := http.Post(addr, "text/plain;charset=UTF-8", strings.NewReader("1:2"))
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected ping to be accepted, got status %d", resp.StatusCode)
+	}
+	resp, err = http.Get(addr)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var payload []packet
+	err = newPayloadDecoder(resp.Body).decode(&payload)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not decode payload: %v", err)
+	}
+	if len(payload) != 3 || payload[2].typ != packetTypePong {
+		t.Fatalf("expected two messages and a pong, got %+v", payload)
+	}
+	// Once the client has polled, the queue has room again.
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Errorf("could not write message after polling: %v", err)
+	}
+}
+
+func TestPostOrdering(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ftcServer.deliveryTimeout = 100 * time.Millisecond
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	defer ftcServer.Shutdown()
+	post := func(sid string, n int) *http.Response {
+		var p []packet
+		for i := 0; i < n; i++ {
+			p = append(p, packet{typ: packetTypeMessage, data: []byte(strconv.Itoa(i))})
+		}
+		var buf bytes.Buffer
+		if err := newPayloadEncoder(&buf).encode(p); err != nil {
+			t.Fatalf("could not encode payload: %v", err)
+		}
+		addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+		resp, err := http.Post(addr, "text/plain;charset=UTF-8", &buf)
+		if err != nil {
+			t.Fatalf("http post error: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// A slow consumer receives every message of the POST in order.
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	received := make(chan []byte, 5)
+	go func(c *Conn) {
+		for {
+			time.Sleep(20 * time.Millisecond)
+			msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}(c)
+	if resp := post(sid, 5); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	for i := 0; i < 5; i++ {
+		if msg := <-received; string(msg) != strconv.Itoa(i) {
+			t.Errorf("expected message %d, got %q", i, msg)
+		}
+	}
+
+	// A consumer that stops reading fails the POST and closes the
+	// connection, so no message is delivered after a dropped one.
+	sid = handshakePolling(ts.URL, ftcServer, t)
+	c = <-conns
+	if resp := post(sid, 15); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	for i := 0; ; i++ {
+		msg, err := c.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || string(msg) != strconv.Itoa(i) {
+			t.Fatalf("expected message %d, got %q, %v", i, msg, err)
+		}
+	}
+	if ftcServer.clients.get(sid) != nil {
+		t.Error("expected the connection to be removed")
+	}
+}
+
+func TestRecvQueueSize(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{RecvQueueSize: 20}, connHandler(conns))
+	ftcServer.deliveryTimeout = 50 * time.Millisecond
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	// Messages up to the queue size are accepted without being read.
+	var p []packet
+	for i := 0; i < 20; i++ {
+		p = append(p, packet{typ: packetTypeMessage, data: []byte(strconv.Itoa(i))})
+	}
+	var buf bytes.Buffer
+	if err := newPayloadEncoder(&buf).encode(p); err != nil {
+		t.Fatalf("could not encode payload: %v", err)
+	}
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	resp, err := http.Post(addr, "text/plain;charset=UTF-8", &buf)
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	for i := 0; i < 20; i++ {
+		msg, err := c.ReadMessage()
+		if err != nil || string(msg) != strconv.Itoa(i) {
+			t.Fatalf("expected message %d, got %q, %v", i, msg, err)
+		}
+	}
+}
+
+func TestUnacked(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{ReplayBufferSize: 10}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	if err := c.WriteBatch([][]byte{[]byte("1"), []byte("2")}); err != nil {
+		t.Fatalf("could not write batch: %v", err)
+	}
+	if _, err := c.WriteString("3"); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	if msgs := pollMessages(addr, t); len(msgs) != 3 {
+		t.Fatalf("expected 3 messages, got %q", msgs)
+	}
+	// The client reports receiving the first message before it is lost.
+	c.Ack(1)
+	c.Close()
+	seq, msgs := c.Unacked()
+	if expected := [][]byte{[]byte("2"), []byte("3")}; seq != 2 || !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected %q from 2, got %q from %d", expected, msgs, seq)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{MaxMessageSize: 5}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Errorf("could not write message within the size limit: %v", err)
+	}
+	if n, err := c.Write([]byte("hello!")); err != ErrMessageTooLarge || n != 0 {
+		t.Errorf("expected (0, %v), got (%d, %v)", ErrMessageTooLarge, n, err)
+	}
+}
+
+func TestPollingClose(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	type result struct {
+		payload []packet
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling&sid=" + sid)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var payload []packet
+		err = newPayloadDecoder(resp.Body).decode(&payload)
+		results <- result{payload, err}
+	}()
+	if err := c.Close(); err != nil {
+		t.Fatalf("problem closing connection: %v", err)
+	}
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("could not poll: %v", r.err)
+	}
+	if len(r.payload) != 1 || r.payload[0].typ != packetTypeClose {
+		t.Errorf("expected a close packet, got %+v", r.payload)
+	}
+}
+
+func TestPollingCompression(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(&Options{EnableCompression: true}, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	for _, msg := range []string{"hello", strings.Repeat("Foo 世 bar baz 界 qux", 100)} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+		req, err := http.NewRequest("GET", addr, nil)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "deflate, gzip;q=1.0")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		defer resp.Body.Close()
+		body := io.Reader(resp.Body)
+		compressed := resp.Header.Get("Content-Encoding") == "gzip"
+		if expected := len(msg) >= compressionThreshold; compressed != expected {
+			t.Errorf("message of length %d: expected compressed to be %t", len(msg), expected)
+		}
+		if compressed {
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatalf("could not read gzip response: %v", err)
+			}
+		}
+		var payload []packet
+		if err := newPayloadDecoder(body).decode(&payload); err != nil {
+			t.Fatalf("could not decode response body: %v", err)
+		}
+		if len(payload) != 1 || string(payload[0].data) != msg {
+			t.Errorf("expected message %q, got %+v", msg, payload)
+		}
+	}
+}
+
+func TestBatchedUpgrade(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket&batch=1&sid="+sid, "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	// Send the probe ping and the upgrade together in a single frame.
+	var buf bytes.Buffer
+	batch := []packet{
+		packet{typ: packetTypePing, data: []byte("probe")},
+		packet{typ: packetTypeUpgrade},
+	}
+	if err := newPayloadEncoder(&buf).encode(batch); err != nil {
+		t.Fatalf("could not encode batch: %v", err)
+	}
+	if err := websocket.Message.Send(ws, buf.String()); err != nil {
+		t.Fatalf("could not send batch: %v", err)
+	}
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode probe response: %v", err)
+	}
+	if pkt.typ != packetTypePong || string(pkt.data) != "probe" {
+		t.Fatalf("expected pong probe, got %+v", pkt)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !c.c.upgraded() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not upgraded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUnbatchedFrame(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	_, ws := upgradePolling(ts, ftcServer, t)
+	defer ws.Close()
+	c := <-conns
+	// Without the batch parameter, a message whose data looks like a
+	// payload is delivered whole.
+	const msg = ":4abc1:4"
+	if err := websocket.Message.Send(ws, "4"+msg); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+	b, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if string(b) != msg {
+		t.Errorf("expected message %q, got %q", msg, b)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	reasons := make(chan DisconnectReason, 2)
+	ftcServer := NewServer(&Options{OnClose: func(c *Conn, err error) {
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			reasons <- closeErr.Reason
+		}
+	}}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	handshakePolling(ts.URL, ftcServer, t)
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	ftcServer.Shutdown()
+	for i := 0; i < 2; i++ {
+		if r := <-reasons; r != DisconnectShutdown {
+			t.Errorf("expected reason %s, got %s", DisconnectShutdown, r)
+		}
+	}
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil || pkt.typ != packetTypeClose {
+		t.Errorf("expected a close packet, got %+v (%v)", pkt, err)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	ids := []string{"a", "a", "", "b"}
+	var mu sync.Mutex
+	ftcServer := NewServer(&Options{IDGenerator: func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(ids) == 0 {
+			return "a"
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	if sid := handshakePolling(ts.URL, ftcServer, t); sid != "a" {
+		t.Errorf("expected session ID %q, got %q", "a", sid)
+	}
+	// Duplicate and empty IDs are skipped.
+	if sid := handshakePolling(ts.URL, ftcServer, t); sid != "b" {
+		t.Errorf("expected session ID %q, got %q", "b", sid)
+	}
+	// The handshake fails once the generator runs out of unused IDs.
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	store := newMemorySessionStore()
+	ids := []string{"a", "a", "b"}
+	var mu sync.Mutex
+	idGenerator := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	serverA := NewServer(&Options{
+		SessionStore: store,
+		ServerID:     "A",
+		IDGenerator:  idGenerator,
+		ReapInterval: 10 * time.Millisecond,
+	}, nil)
+	serverB := NewServer(&Options{SessionStore: store, ServerID: "B", IDGenerator: idGenerator}, nil)
+	tsA, tsB := httptest.NewServer(serverA), httptest.NewServer(serverB)
+	defer tsA.Close()
+	defer tsB.Close()
+	if sid := handshakePolling(tsA.URL, serverA, t); sid != "a" {
+		t.Errorf("expected session ID %q, got %q", "a", sid)
+	}
+	// IDs owned by another server are skipped.
+	if sid := handshakePolling(tsB.URL, serverB, t); sid != "b" {
+		t.Errorf("expected session ID %q, got %q", "b", sid)
+	}
+	for id, owner := range map[string]string{"a": "A", "b": "B"} {
+		if o, _ := store.Get(id); o != owner {
+			t.Errorf("session %q: expected owner %q, got %q", id, owner, o)
+		}
+	}
+	if !serverA.Disconnect("a") {
+		t.Fatal("could not disconnect session")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ok, _ := store.Exists("a"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session was not removed from the store")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	ftcServer := NewServer(nil, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	handshakePolling(ts.URL, ftcServer, t)
+	w := httptest.NewRecorder()
+	ftcServer.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var health struct {
+		Uptime      int64
+		Connections int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &health); err != nil {
+		t.Fatalf("json unmarshal error: %v", err)
+	}
+	if health.Connections != 1 || health.Uptime < 0 {
+		t.Errorf("expected one connection and a non-negative uptime, got %+v", health)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	received := make(chan []byte, 1)
+	ftcServer := NewServer(nil, Handler(func(c *Conn) {
+		b := make([]byte, 64)
+		n, err := c.Read(b)
+		if err == nil {
+			received <- b[:n]
+		}
+	}))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	defer ftcServer.Shutdown()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	ftcServer.Drain()
+
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	w := httptest.NewRecorder()
+	ftcServer.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected health status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	// Messages from the client are rejected so that it retries them
+	// elsewhere, while other packets are still handled.
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	for body, expected := range map[string]int{
+		"1:2":      http.StatusOK,
+		"1:23:4hi": http.StatusServiceUnavailable,
+	} {
+		resp, err := http.Post(addr, "text/plain;charset=UTF-8", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("http post error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%q: expected status %d, got %d", body, expected, resp.StatusCode)
+		}
+		if retry := resp.Header.Get("Retry-After"); expected != http.StatusOK && len(retry) == 0 {
+			t.Errorf("%q: expected a Retry-After header", body)
+		}
+	}
+	// The existing connection still delivers messages written to it.
+	ftcServer.ForEach(func(conn *Conn) bool {
+		if _, err := conn.WriteString("bye"); err != nil {
+			t.Errorf("write error: %v", err)
+		}
+		return true
+	})
+	msgs := pollMessages(addr, t)
+	if len(msgs) != 1 || string(msgs[0]) != "bye" {
+		t.Errorf("expected message %q, got %q", "bye", msgs)
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("expected message to be rejected, got %q", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandshakeMaxPayload(t *testing.T) {
+	ftcServer := NewServer(&Options{MaxPayloadSize: 1000}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	for protocol, expected := range map[string]interface{}{"3": nil, "4": 1000.0} {
+		resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling&EIO=" + protocol)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		var payload []packet
+		err = newPayloadDecoder(resp.Body).decode(&payload)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("could not decode payload from response body: %v", err)
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(payload[0].data, &m); err != nil {
+			t.Fatalf("json unmarshal error: %v", err)
+		}
+		if m["maxPayload"] != expected {
+			t.Errorf("EIO=%s: expected maxPayload %v, got %v", protocol, expected, m["maxPayload"])
+		}
+	}
+}
+
+func TestHandshakeExtras(t *testing.T) {
+	ftcServer := NewServer(&Options{HandshakeExtras: func(r *http.Request) map[string]interface{} {
+		return map[string]interface{}{"region": r.FormValue("region"), "sid": "clobbered"}
+	}}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling&region=us-east")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var payload []packet
+	err = newPayloadDecoder(resp.Body).decode(&payload)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not decode payload from response body: %v", err)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(payload[0].data, &m); err != nil {
+		t.Fatalf("json unmarshal error: %v", err)
+	}
+	if m["region"] != "us-east" {
+		t.Errorf("expected region %q, got %v", "us-east", m["region"])
+	}
+	if sid, _ := m["sid"].(string); sid == "clobbered" || ftcServer.clients.get(sid) == nil {
+		t.Errorf("expected the reserved sid field to be kept, got %q", sid)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ts := httptest.NewServer(NewServer(nil, connHandler(conns)))
+	defer ts.Close()
+	const ua = "Mozilla/5.0 (test)"
+	req, err := http.NewRequest("GET", ts.URL+defaultBasePath+"?transport=polling", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", ua)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	resp.Body.Close()
+	c := <-conns
+	if v := c.UserAgent(); v != ua {
+		t.Errorf("expected user agent %q, got %q", ua, v)
+	}
+	c.Close()
+	if v := c.UserAgent(); v != ua {
+		t.Errorf("expected user agent %q after close, got %q", ua, v)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ftcServer := NewServer(nil, echoHandler)
+	var order []string
+	var mu sync.Mutex
+	for _, name := range []string{"first", "second"} {
+		name := name
+		ftcServer.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				if r.FormValue("token") != "secret" {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	for _, transport := range []string{transportPolling, transportWebSocket} {
+		resp, err := http.Get(ts.URL + defaultBasePath + "?transport=" + transport)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected status %d, got %d", transport, http.StatusForbidden, resp.StatusCode)
+		}
+	}
+	if !reflect.DeepEqual(order, []string{"first", "first"}) {
+		t.Errorf("expected only the first middleware to run, got %v", order)
+	}
+	order = nil
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling&token=secret")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second"}) {
+		t.Errorf("expected middleware to run in order, got %v", order)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ftcServer := NewServer(&Options{Authenticate: func(r *http.Request) error {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	// WebSocket handshakes are rejected before the WebSocket opens.
+	serverAddr := ts.Listener.Addr().String()
+	if ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr); err == nil {
+		ws.Close()
+		t.Fatal("expected websocket dial to be rejected")
+	}
+	resp, err = http.Get(ts.URL + defaultBasePath + "?transport=websocket")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var msg map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not decode error message: %v", err)
+	}
+	if msg["code"] != float64(errorBadRequest) {
+		t.Errorf("expected error code %d, got %v", errorBadRequest, msg["code"])
+	}
+	if n := ftcServer.clients.len(); n != 0 {
+		t.Errorf("expected no connections to be created, got %d", n)
+	}
+	req, err := http.NewRequest("GET", ts.URL+defaultBasePath+"?transport=polling", nil)
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	ftcServer := NewServer(&Options{
+		ErrorMessages: map[int]string{
+			errorUnknownSID: "Session inconnue",
+			1001:            "Token expired",
+		},
+		Authenticate: func(r *http.Request) error {
+			if r.FormValue("token") == "expired" {
+				return fmt.Errorf("rejected: %w", ErrorCode(1001))
+			}
+			return nil
+		},
+	}, nil)
+	ftcServer.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.FormValue("token") == "banned" {
+				ftcServer.WriteError(w, r, errorBadRequest)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	for query, expected := range map[string]struct {
+		code    int
+		message string
+	}{
+		"&sid=bogus":     {errorUnknownSID, "Session inconnue"},
+		"&token=expired": {1001, "Token expired"},
+		"&token=banned":  {errorBadRequest, "Bad request"},
+	} {
+		resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling" + query)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		var msg struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&msg)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: json decode error: %v", query, err)
+		}
+		if resp.StatusCode != http.StatusBadRequest || msg.Code != expected.code || msg.Message != expected.message {
+			t.Errorf("%s: expected %+v, got status %d with %+v", query, expected, resp.StatusCode, msg)
+		}
+	}
+}
+
+func TestOverlappingPoll(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	defer ftcServer.Shutdown()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	first := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(addr)
+		if err != nil {
+			t.Errorf("http get error: %v", err)
+			first <- ""
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		first <- string(b)
+	}()
+	for {
+		c.c.mu.RLock()
+		polling := c.c.polling
+		c.c.mu.RUnlock()
+		if polling {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The second poll is rejected while the first is outstanding.
+	resp, err := http.Get(addr)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var msg struct{ Code int }
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || err != nil || msg.Code != errorOverlappingPoll {
+		t.Errorf("expected status %d and error code %d, got %d, %+v, %v", http.StatusBadRequest, errorOverlappingPoll, resp.StatusCode, msg, err)
+	}
+	if _, err := c.WriteString("hello"); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	if b := <-first; b != "6:4hello" {
+		t.Errorf("expected the first poll to receive %q, got %q", "6:4hello", b)
+	}
+	// Once the first poll is done, the next one is accepted.
+	if _, err := c.WriteString("again"); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	if msgs := pollMessages(addr, t); len(msgs) != 1 || string(msgs[0]) != "again" {
+		t.Errorf("expected message %q, got %q", "again", msgs)
+	}
+}
+
+func TestPollingResume(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ftcServer := NewServer(nil, connHandler(conns))
+	polled := make(chan struct{}, 1)
+	ftcServer.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r)
+			if r.Method == "GET" && len(r.FormValue(paramSessionID)) > 0 {
+				polled <- struct{}{}
+			}
+		})
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	c := <-conns
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	// A poll that the client gives up on must not take any messages.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", addr, nil)
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected poll to time out")
+	}
+	<-polled
+	var expected [][]byte
+	for i := 0; i < 5; i++ {
+		msg := []byte(strconv.Itoa(i))
+		if _, err := c.Write(msg); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+		expected = append(expected, msg)
+	}
+	var received [][]byte
+	for len(received) < len(expected) {
+		received = append(received, pollMessages(addr, t)...)
+		<-polled
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected messages %q exactly once in order, got %q", expected, received)
+	}
+}
+
+func TestOnPacket(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[PacketType]int{}
+	opts := &Options{
+		OnPacket: func(c *Conn, typ PacketType, data []byte) bool {
+			mu.Lock()
+			seen[typ]++
+			mu.Unlock()
+			return typ != PacketMessage || string(data) != "drop"
+		},
+	}
+	ts := httptest.NewServer(NewServer(opts, echoHandler))
+	defer ts.Close()
+	c, err := Dial(ts.URL+defaultBasePath, &ClientOptions{Upgrade: true})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	for _, msg := range []string{"drop", "hello"} {
+		if _, err := c.WriteString(msg); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	b := make([]byte, 64)
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if string(b[:n]) != "hello" {
+		t.Errorf("expected echo of %q, got %q", "hello", b[:n])
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if seen[PacketUpgrade] != 1 || seen[PacketMessage] != 2 {
+		t.Errorf("expected one upgrade and two message packets, got %v", seen)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	for _, tc := range []struct {
+		maxAge   time.Duration
+		expected string
+	}{
+		{0, "600"},
+		{2 * time.Minute, "120"},
+		{-1, ""},
+	} {
+		ts := httptest.NewServer(NewServer(&Options{CORSMaxAge: tc.maxAge}, nil))
+		req, err := http.NewRequest("OPTIONS", ts.URL+defaultBasePath+"?transport=polling", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", "http://example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		resp, err := http.DefaultClient.Do(req)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("expected status code %d, got %d", http.StatusNoContent, resp.StatusCode)
+		}
+		for header, expected := range map[string]string{
+			"Access-Control-Allow-Origin":      "http://example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods":     "GET, POST, OPTIONS",
+			"Access-Control-Allow-Headers":     "content-type",
+			"Access-Control-Max-Age":           tc.expected,
+		} {
+			if v := resp.Header.Get(header); v != expected {
+				t.Errorf("max age %v: %s: expected %q, got %q", tc.maxAge, header, expected, v)
+			}
+		}
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	ftcServer := NewServer(&Options{ResponseHeaders: http.Header{
+		"X-Accel-Buffering": {"no"},
+		"X-Correlation-Id":  {"abc"},
+	}}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	for _, url := range []string{
+		ts.URL + defaultBasePath + "?transport=polling",
+		ts.URL + defaultBasePath + "?transport=polling&sid=bogus",
+	} {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		resp.Body.Close()
+		for header, expected := range map[string]string{
+			"X-Accel-Buffering": "no",
+			"X-Correlation-Id":  "abc",
+		} {
+			if v := resp.Header.Get(header); v != expected {
+				t.Errorf("%s: %s: expected %q, got %q", url, header, expected, v)
+			}
+		}
+	}
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	resp, err := http.Post(addr, "text/plain;charset=UTF-8", strings.NewReader("6:4hello"))
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get("X-Accel-Buffering"); v != "no" {
+		t.Errorf("X-Accel-Buffering: expected %q, got %q", "no", v)
+	}
+}
+
+func TestServerTransport(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ts := httptest.NewServer(NewServer(nil, Handler(func(c *Conn) {
+		conns <- c
+		io.Copy(c, c)
+	})))
+	defer ts.Close()
+	c, err := Dial(ts.URL+defaultBasePath, &ClientOptions{Upgrade: true})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	sc := <-conns
+	// The server completes the upgrade once it receives the upgrade
+	// packet, which it may not have yet.
+	deadline := time.Now().Add(5 * time.Second)
+	for !sc.Upgraded() {
+		if time.Now().After(deadline) {
+			t.Fatal("server connection was not upgraded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sc.Transport() != "websocket" {
+		t.Errorf("expected transport %q, got %q", "websocket", sc.Transport())
+	}
+}
+
+func TestDisableUpgrades(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	ts := httptest.NewServer(NewServer(&Options{DisableUpgrades: true}, Handler(func(c *Conn) {
+		conns <- c
+		io.Copy(c, c)
+	})))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var payload []packet
+	err = newPayloadDecoder(resp.Body).decode(&payload)
+	resp.Body.Close()
+	if err != nil || len(payload) == 0 {
+		t.Fatalf("could not decode handshake: %v", err)
+	}
+	var hs struct {
+		Upgrades []string `json:"upgrades"`
+	}
+	if err := json.Unmarshal(payload[0].data, &hs); err != nil {
+		t.Fatalf("json unmarshal error: %v", err)
+	}
+	if hs.Upgrades == nil || len(hs.Upgrades) != 0 {
+		t.Errorf("expected no upgrades to be offered, got %v", hs.Upgrades)
+	}
+	resp, err = http.Get(ts.URL + defaultBasePath + "?transport=websocket")
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var msg struct {
+		Code int `json:"code"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("json decode error: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || msg.Code != errorTransportUnknown {
+		t.Errorf("expected status %d with code %d, got %d with code %d",
+			http.StatusBadRequest, errorTransportUnknown, resp.StatusCode, msg.Code)
+	}
+	// A client asking to upgrade stays on polling.
+	c, err := Dial(ts.URL+defaultBasePath, &ClientOptions{Upgrade: true})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer c.Close()
+	sc := <-conns
+	if _, err := c.WriteString("hello"); err != nil {
+		t.Fatalf("could not write message: %v", err)
+	}
+	b, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("expected %q, got %q", "hello", b)
+	}
+	if sc.Transport() != transportPolling || sc.Upgraded() {
+		t.Errorf("expected the connection to stay on polling, got %q", sc.Transport())
+	}
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	ts := httptest.NewServer(NewServer(&Options{
+		HandshakeRateLimit: RateLimit{Rate: 0.01, Burst: 3},
+		TrustedProxies:     []string{"127.0.0.1", "10.0.0.0/8"},
+	}, nil))
+	defer ts.Close()
+	handshake := func(ip string) int {
+		req, err := http.NewRequest("GET", ts.URL+defaultBasePath+"?transport=polling", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", ip+", 10.0.0.1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < 10; i++ {
+		expected := http.StatusOK
+		if i >= 3 {
+			expected = http.StatusTooManyRequests
+		}
+		if code := handshake("192.0.2.1"); code != expected {
+			t.Errorf("handshake %d: expected status %d, got %d", i, expected, code)
+		}
+	}
+	if code := handshake("192.0.2.2"); code != http.StatusOK {
+		t.Errorf("expected handshake from another IP to succeed, got status %d", code)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	s := NewServer(&Options{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1", "bogus"}}, nil)
+	if n := len(s.trustedProxies); n != 2 {
+		t.Fatalf("expected 2 trusted proxies, got %d", n)
+	}
+	for _, tc := range []struct {
+		remoteAddr, forwardedFor, proto string
+		expectedIP, expectedProto       string
+	}{
+		// Headers from untrusted addresses are ignored.
+		{"198.51.100.7:1234", "203.0.113.9", "https", "198.51.100.7", ""},
+		{"10.1.2.3:1234", "203.0.113.9", "https", "203.0.113.9", "https"},
+		{"192.0.2.1:1234", "203.0.113.9:5678", "", "203.0.113.9", ""},
+		// Entries added by trusted proxies are skipped, and those before
+		// the last untrusted one may be forged.
+		{"10.1.2.3:1234", "198.51.100.1, 203.0.113.9, 10.0.0.5", "", "203.0.113.9", ""},
+		{"10.1.2.3:1234", "10.0.0.6, 10.0.0.5", "", "10.0.0.6", ""},
+		{"10.1.2.3:1234", "", "", "10.1.2.3", ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if len(tc.forwardedFor) > 0 {
+			r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		r.Header.Set("X-Forwarded-Proto", tc.proto)
+		if ip := s.remoteIP(r); ip != tc.expectedIP {
+			t.Errorf("%s via %s: expected IP %q, got %q", tc.forwardedFor, tc.remoteAddr, tc.expectedIP, ip)
+		}
+		if proto := s.forwardedProto(r); proto != tc.expectedProto {
+			t.Errorf("%s via %s: expected proto %q, got %q", tc.forwardedFor, tc.remoteAddr, tc.expectedProto, proto)
+		}
+	}
+}
+
+func TestWebSocketHandlerEarlyExit(t *testing.T) {
+	// Serving the WebSocket server directly skips the checks made
+	// before the WebSocket handshake, so that wsHandler must give up
+	// before it has a conn.
+	ftcServer := NewServer(&Options{IDGenerator: func() string { return "" }}, nil)
+	ts := httptest.NewServer(ftcServer.wsServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	for query, expectClose := range map[string]bool{
+		// The session is unknown, as though it had been reaped.
+		"?transport=websocket&sid=bogus": true,
+		// No session ID can be generated for a new conn.
+		"?transport=websocket": false,
+	} {
+		ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+query, "", ts.URL)
+		if err != nil {
+			t.Fatalf("%s: websocket dial error: %v", query, err)
+		}
+		dec := newPacketDecoder(ws)
+		var pkt packet
+		if expectClose {
+			if err := dec.decode(&pkt); err != nil {
+				t.Fatalf("%s: could not decode packet: %v", query, err)
+			}
+			if pkt.typ != packetTypeClose {
+				t.Errorf("%s: expected packet type to be close (1), got %q", query, pkt.typ)
+			}
+		}
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if err := dec.decode(&pkt); err != io.EOF {
+			t.Errorf("%s: expected the server to close the websocket, got %v", query, err)
+		}
+		ws.Close()
+	}
+	if n := ftcServer.clients.len(); n != 0 {
+		t.Errorf("expected no connections, got %d", n)
+	}
+}
+
+func TestWebSocketUnknownSID(t *testing.T) {
+	ts := httptest.NewServer(NewServer(nil, nil))
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	addr := defaultBasePath + "?transport=websocket&sid=bogus"
+	if ws, err := websocket.Dial("ws://"+serverAddr+addr, "", ts.URL); err == nil {
+		ws.Close()
+		t.Fatal("expected websocket dial with an unknown sid to fail")
+	}
+	resp, err := http.Get(ts.URL + addr)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	var msg struct {
+		Code int `json:"code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		t.Fatalf("json decode error: %v", err)
+	}
+	if msg.Code != errorUnknownSID {
+		t.Errorf("expected error code %d, got %d", errorUnknownSID, msg.Code)
+	}
+}
+
+func TestForceBase64(t *testing.T) {
+	ftcServer := NewServer(nil, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	for query, expected := range map[string]bool{"": false, "&b64=1": true} {
+		resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling" + query)
+		if err != nil {
+			t.Fatalf("http get error: %v", err)
+		}
+		resp.Body.Close()
+		cookies := resp.Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("expected one cookie, got %d", len(cookies))
+		}
+		c := ftcServer.clients.get(cookies[0].Value)
+		if c == nil {
+			t.Fatalf("%q: connection not found", query)
+		}
+		if c.forceBase64 != expected {
+			t.Errorf("%q: expected forceBase64 to be %t", query, expected)
+		}
+	}
+}
+
+func TestWriteBinary(t *testing.T) {
+	data := []byte{0, 1, 2, 0xff}
+	ftcServer := NewServer(nil, func(c *Conn) {
+		if _, err := c.WriteBinary(data); err != nil {
+			t.Errorf("could not write binary message: %v", err)
+		}
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	testCases := []struct {
+		query  string
+		binary bool
+		data   []byte
+	}{
+		{"", true, data},
+		{"&b64=1", false, []byte("b4AAEC/w==")},
+	}
+	for _, testCase := range testCases {
+		ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket"+testCase.query, "", "http://"+serverAddr)
+		if err != nil {
+			t.Fatalf("websocket dial error: %v", err)
+		}
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var f frame
+		for {
+			if err := frameCodec.Receive(ws, &f); err != nil {
+				t.Fatalf("%q: could not receive frame: %v", testCase.query, err)
+			}
+			if f.binary || len(f.data) == 0 || f.data[0] != packetTypeOpen {
+				break
+			}
+		}
+		if f.binary != testCase.binary || !bytes.Equal(f.data, testCase.data) {
+			t.Errorf("%q: expected frame %q (binary: %t), got %q (binary: %t)", testCase.query, testCase.data, testCase.binary, f.data, f.binary)
+		}
+		ws.Close()
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	ftcServer := NewServer(&Options{ReadTimeout: 20 * time.Millisecond}, func(c *Conn) {
+		_, err := c.Read(make([]byte, 64))
+		errs <- err
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	handshakePolling(ts.URL, ftcServer, t)
+	select {
+	case err := <-errs:
+		if err != ErrReadTimeout {
+			t.Errorf("expected error %v, got %v", ErrReadTimeout, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read did not time out")
+	}
+}
+
+func TestClientCloseRemovesConn(t *testing.T) {
+	ftcServer := NewServer(&Options{ReapInterval: time.Hour}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	resp, err := http.Post(addr, "text/plain;charset=UTF-8", strings.NewReader("1:1"))
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	resp.Body.Close()
+	// The conn is removed as soon as the close packet is handled.
+	if c := ftcServer.clients.get(sid); c != nil {
+		t.Fatalf("expected closed connection to be removed, got %+v", c)
+	}
+	resp, err = http.Get(addr)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d for a closed session, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	ftcServer := NewServer(&Options{WriteTimeout: 50 * time.Millisecond}, func(c *Conn) {
+		msg := bytes.Repeat([]byte("a"), 64<<10)
+		for i := 0; i < 4096; i++ {
+			if _, err := c.Write(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	// The client never reads, so the server’s writes eventually block.
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	select {
+	case err := <-errs:
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			t.Fatalf("expected a timeout error, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("write did not time out")
+	}
+}
+
+func TestCloseBlockedWrite(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	errs := make(chan error, 1)
+	ftcServer := NewServer(&Options{WriteTimeout: -1}, func(c *Conn) {
+		conns <- c
+		msg := bytes.Repeat([]byte("a"), 64<<10)
+		for {
+			if _, err := c.Write(msg); err != nil {
+				errs <- err
+				return
+			}
+		}
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	serverAddr := ts.Listener.Addr().String()
+	// The client never reads, and the writes have no deadline, so the
+	// server’s writes block until the conn is closed.
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	c := <-conns
+	time.Sleep(200 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("close was held up by a blocked write")
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected a write error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocked write did not fail after close")
+	}
+}
+
+func TestOnUpgrade(t *testing.T) {
+	upgrades := make(chan *Conn, 2)
+	ftcServer := NewServer(&Options{OnUpgrade: func(c *Conn) {
+		upgrades <- c
+		if _, err := c.WriteString("upgraded"); err != nil {
+			t.Errorf("write error: %v", err)
+		}
+	}}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	_, ws := upgradePolling(ts, ftcServer, t)
+	defer ws.Close()
+	// A repeated upgrade packet does not fire the hook again.
+	if err := newPacketEncoder(ws).encode(packet{typ: packetTypeUpgrade}); err != nil {
+		t.Fatalf("could not send upgrade: %v", err)
+	}
+	c := <-upgrades
+	if c.Transport() != "websocket" {
+		t.Errorf("expected transport %q in the hook, got %q", "websocket", c.Transport())
+	}
+	var pkt packet
+	if err := newPacketDecoder(ws).decode(&pkt); err != nil {
+		t.Fatalf("could not decode packet: %v", err)
+	}
+	if pkt.typ != packetTypeMessage || string(pkt.data) != "upgraded" {
+		t.Errorf("expected the hook’s message over the websocket, got %+v", pkt)
+	}
+	select {
+	case <-upgrades:
+		t.Error("expected the hook to fire once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServerErrorFormat(t *testing.T) {
+	ts := httptest.NewServer(NewServer(nil, nil))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL+defaultBasePath+"?transport=polling&sid=bogus", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	defer resp.Body.Close()
+	// engine.io clients treat any non-200 status as an error and read
+	// the code from the JSON body, which browsers only expose to
+	// cross-origin clients if CORS headers are set.
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+	for header, expected := range map[string]string{
+		"Content-Type":                "application/json",
+		"Access-Control-Allow-Origin": "http://example.com",
+	} {
+		if v := resp.Header.Get(header); v != expected {
+			t.Errorf("%s: expected %q, got %q", header, expected, v)
+		}
+	}
+	var msg struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		t.Fatalf("json decode error: %v", err)
+	}
+	if msg.Code != errorUnknownSID || msg.Message != errorMessage[errorUnknownSID] {
+		t.Errorf("unexpected error message %+v", msg)
+	}
+}
+
+func TestCloseWithReason(t *testing.T) {
+	ftcServer := NewServer(nil, func(c *Conn) {
+		c.CloseWithReason(4001, "auth expired")
+	})
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	expected := `{"code":4001,"message":"auth expired"}`
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	resp, err := http.Get(ts.URL + defaultBasePath + "?transport=polling&sid=" + sid)
+	if err != nil {
+		t.Fatalf("http get error: %v", err)
+	}
+	var payload []packet
+	err = newPayloadDecoder(resp.Body).decode(&payload)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("could not decode response body: %v", err)
+	}
+	if len(payload) != 1 || payload[0].typ != packetTypeClose || string(payload[0].data) != expected {
+		t.Errorf("expected a close packet with data %s, got %+v", expected, payload)
+	}
+
+	// A WebSocket client receives the close packet before the WebSocket closes.
+	serverAddr := ts.Listener.Addr().String()
+	ws, err := websocket.Dial("ws://"+serverAddr+defaultBasePath+"?transport=websocket", "", "http://"+serverAddr)
+	if err != nil {
+		t.Fatalf("websocket dial error: %v", err)
+	}
+	defer ws.Close()
+	dec := newPacketDecoder(ws)
+	for {
+		var pkt packet
+		if err := dec.decode(&pkt); err != nil {
+			t.Fatalf("could not decode packet: %v", err)
+		}
+		if pkt.typ == packetTypeClose {
+			if string(pkt.data) != expected {
+				t.Errorf("expected close data %s, got %s", expected, pkt.data)
+			}
+			break
+		}
+	}
+}
+
+func TestBroadcastTo(t *testing.T) {
+	conns := make(chan *Conn, 3)
+	ftcServer := NewServer(nil, connHandler(conns))
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	var sids []string
+	for i := 0; i < 3; i++ {
+		sids = append(sids, handshakePolling(ts.URL, ftcServer, t))
+	}
+	members := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		c := <-conns
+		if i < 2 {
+			c.Join("room")
+			members[c.c.id] = true
+		}
+	}
+	ftcServer.BroadcastTo("room", []byte("hello"))
+	for _, sid := range sids {
+		if !members[sid] {
+			continue
+		}
+		msgs := pollMessages(ts.URL+defaultBasePath+"?transport=polling&sid="+sid, t)
+		if len(msgs) != 1 || string(msgs[0]) != "hello" {
+			t.Errorf("%s: expected the broadcast message, got %q", sid, msgs)
+		}
+	}
+	// Closed connections leave their rooms.
+	for sid := range members {
+		ftcServer.Disconnect(sid)
+	}
+	if m := ftcServer.rooms.members("room"); len(m) != 0 {
+		t.Errorf("expected closed connections to leave the room, got %d members", len(m))
+	}
+}
+
+func TestWSKeepalive(t *testing.T) {
+	ts := httptest.NewServer(NewServer(&Options{WSKeepalive: 10 * time.Millisecond}, nil))
+	defer ts.Close()
+	// Dial by hand, since the websocket package hides control frames.
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET %s?transport=websocket HTTP/1.1\r\nHost: %s\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nOrigin: %s\r\n\r\n",
+		defaultBasePath, ts.Listener.Addr(), ts.URL)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("could not read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+	// Server frames are unmasked; skip data frames until a ping.
+	for {
+		var hdr [2]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			t.Fatalf("could not read frame: %v", err)
+		}
+		n := int64(hdr[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(br, ext[:])
+			n = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(br, ext[:])
+			n = int64(binary.BigEndian.Uint64(ext[:]))
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, n); err != nil {
+			t.Fatalf("could not read frame payload: %v", err)
+		}
+		if opcode := hdr[0] & 0x0f; opcode == websocket.PingFrame {
+			return
+		}
+	}
+}
+
+func TestCloseData(t *testing.T) {
+	closes := make(chan *CloseError, 1)
+	ftcServer := NewServer(&Options{OnClose: func(c *Conn, err error) {
+		closes <- err.(*CloseError)
+	}}, nil)
+	ts := httptest.NewServer(ftcServer)
+	defer ts.Close()
+	sid := handshakePolling(ts.URL, ftcServer, t)
+	addr := ts.URL + defaultBasePath + "?transport=polling&sid=" + sid
+	resp, err := http.Post(addr, "text/plain;charset=UTF-8", strings.NewReader("7:1logout"))
+	if err != nil {
+		t.Fatalf("http post error: %v", err)
+	}
+	resp.Body.Close()
+	select {
+	case cerr := <-closes:
+		if cerr.Reason != DisconnectClient || string(cerr.Data) != "logout" {
+			t.Errorf("expected a client close with data %q, got %+v", "logout", cerr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+}
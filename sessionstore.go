@@ -0,0 +1,78 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSessionExists is returned by a SessionStore when a session ID
+// is added that is already in use.
+var ErrSessionExists = errors.New("session already exists")
+
+// A SessionStore records which server owns each session. Connections
+// themselves live in the server that created them, so a store shared
+// by several servers cannot hand a request to another server, but it
+// lets them avoid session ID collisions and lets a router or
+// middleware added with Use find the server that owns a request’s
+// session and forward the request there.
+//
+// A SessionStore must be safe for concurrent use.
+type SessionStore interface {
+	// Add records that the session with the given ID is owned by
+	// owner. It returns ErrSessionExists if the ID is in use.
+	Add(id, owner string) error
+	// Get returns the owner of the session with the given ID, or an
+	// empty string if there is no such session.
+	Get(id string) (owner string, err error)
+	// Remove removes the session with the given ID.
+	Remove(id string) error
+	// Exists reports whether there is a session with the given ID.
+	Exists(id string) (bool, error)
+}
+
+// A memorySessionStore is the default SessionStore. It is only
+// visible to the server that created it.
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]string
+}
+
+// newMemorySessionStore returns an empty memorySessionStore.
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: map[string]string{}}
+}
+
+func (m *memorySessionStore) Add(id, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[id]; ok {
+		return ErrSessionExists
+	}
+	m.sessions[id] = owner
+	return nil
+}
+
+func (m *memorySessionStore) Get(id string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sessions[id], nil
+}
+
+func (m *memorySessionStore) Remove(id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memorySessionStore) Exists(id string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.sessions[id]
+	return ok, nil
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2014, Markover Inc.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/poptip/ftc
+
+package ftc
+
+import "testing"
+
+func TestMemorySessionStore(t *testing.T) {
+	var store SessionStore = newMemorySessionStore()
+	if err := store.Add("a", "node1"); err != nil {
+		t.Fatalf("could not add session: %v", err)
+	}
+	if err := store.Add("a", "node2"); err != ErrSessionExists {
+		t.Errorf("expected error %v, got %v", ErrSessionExists, err)
+	}
+	if owner, _ := store.Get("a"); owner != "node1" {
+		t.Errorf("expected owner node1, got %q", owner)
+	}
+	if err := store.Remove("a"); err != nil {
+		t.Fatalf("could not remove session: %v", err)
+	}
+	if ok, _ := store.Exists("a"); ok {
+		t.Error("expected session to be removed")
+	}
+	if owner, _ := store.Get("a"); owner != "" {
+		t.Errorf("expected no owner, got %q", owner)
+	}
+}